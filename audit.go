@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Every change of claims, roles, mappings, default claims and context settings is recorded in the
+// AuditLog table, in the transaction of the change itself. Each entry stores the hash of its
+// predecessor and its own hash over both, so that editing or deleting an entry breaks the chain.
+const (
+	auditActionCreate = "create"
+	auditActionUpdate = "update"
+	auditActionDelete = "delete"
+
+	auditEntityClaim        = "claim"
+	auditEntityRole         = "role"
+	auditEntityMapping      = "mapping"
+	auditEntityDefaultClaim = "default_claim"
+	auditEntityContext      = "context"
+
+	// auditActorSystem is recorded for changes made by the service itself, e.g. seeding default claims
+	// or archiving expired mappings
+	auditActorSystem = "system"
+
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+)
+
+type auditEntry struct {
+	Id        int64     `gorm:"column:Id;primaryKey"`
+	Time      time.Time `gorm:"column:Time;not null;index"`
+	RequestId string    `gorm:"column:RequestId;not null;default:''"`
+	Subject   string    `gorm:"column:Subject;not null;default:'';index"`
+	Issuer    string    `gorm:"column:Issuer;not null;default:''"`
+	Action    string    `gorm:"column:Action;not null"`
+	Entity    string    `gorm:"column:Entity;not null;index:idx_audit_entity"`
+	EntityId  string    `gorm:"column:EntityId;not null;index:idx_audit_entity"`
+	// Before and After hold the row as JSON text, kept byte for byte so that the hash stays verifiable
+	Before   *string `gorm:"column:Before;type:text"`
+	After    *string `gorm:"column:After;type:text"`
+	PrevHash string  `gorm:"column:PrevHash;not null"`
+	Hash     string  `gorm:"column:Hash;not null;uniqueIndex"`
+}
+
+type auditFilter struct {
+	Entity, EntityId, Action, Subject, RequestId string
+	From, Until                                  *time.Time
+	AfterId                                      int64
+	Limit                                        int
+}
+
+type auditVerification struct {
+	Valid          bool   `json:"valid"`
+	Entries        int64  `json:"entries"`
+	FirstInvalidId *int64 `json:"first_invalid_id,omitempty"`
+	LastHash       string `json:"last_hash"`
+}
+
+func (e auditEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Id        int64           `json:"id"`
+		Time      string          `json:"time"`
+		RequestId string          `json:"request_id"`
+		Subject   string          `json:"subject"`
+		Issuer    string          `json:"issuer"`
+		Action    string          `json:"action"`
+		Entity    string          `json:"entity"`
+		EntityId  string          `json:"entity_id"`
+		Before    json.RawMessage `json:"before"`
+		After     json.RawMessage `json:"after"`
+		PrevHash  string          `json:"prev_hash"`
+		Hash      string          `json:"hash"`
+	}{e.Id, e.Time.UTC().Format(time.RFC3339Nano), e.RequestId, e.Subject, e.Issuer, e.Action, e.Entity, e.EntityId,
+		rawJSON(e.Before), rawJSON(e.After), e.PrevHash, e.Hash})
+}
+
+func rawJSON(value *string) json.RawMessage {
+	if value == nil {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(*value)
+}
+
+// computeHash hashes the entry content together with the hash of the previous entry
+func (e auditEntry) computeHash() string {
+	content, _ := json.Marshal([]interface{}{
+		e.PrevHash, e.Time.UTC().Format(time.RFC3339Nano), e.RequestId, e.Subject, e.Issuer,
+		e.Action, e.Entity, e.EntityId, e.Before, e.After,
+	})
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// writeAuditEntry appends an entry to the chain. Writers are serialized by an advisory lock held
+// until the transaction ends, so every entry links to the one committed before it.
+func writeAuditEntry(ctx context.Context, tx pgx.Tx, action string, entity string, entityId string, before *string, after *string) error {
+	requestId, subject, issuer := requestActor(ctx)
+	if len(requestId) == 0 && len(subject) == 0 {
+		subject = auditActorSystem
+	}
+
+	_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('AuditLog'))")
+	if err != nil {
+		return err
+	}
+
+	entry := auditEntry{
+		Time:      time.Now().UTC().Truncate(time.Microsecond),
+		RequestId: requestId,
+		Subject:   subject,
+		Issuer:    issuer,
+		Action:    action,
+		Entity:    entity,
+		EntityId:  entityId,
+		Before:    before,
+		After:     after,
+	}
+	err = tx.QueryRow(ctx, "SELECT COALESCE((SELECT \"Hash\" FROM public.\"AuditLog\" ORDER BY \"Id\" DESC LIMIT 1), '')").Scan(&entry.PrevHash)
+	if err != nil {
+		return err
+	}
+	entry.Hash = entry.computeHash()
+
+	_, err = tx.Exec(ctx, "INSERT INTO public.\"AuditLog\" (\"Time\", \"RequestId\", \"Subject\", \"Issuer\", \"Action\", \"Entity\", \"EntityId\", \"Before\", \"After\", \"PrevHash\", \"Hash\") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
+		entry.Time, entry.RequestId, entry.Subject, entry.Issuer, entry.Action, entry.Entity, entry.EntityId, entry.Before, entry.After, entry.PrevHash, entry.Hash)
+	return err
+}
+
+// auditInsert runs an INSERT ending in RETURNING <alias>."Id"::text, to_jsonb(<alias>)::text and
+// records the created row
+func auditInsert(ctx context.Context, tx pgx.Tx, entity string, sql string, args ...interface{}) error {
+	var entityId, after string
+	err := tx.QueryRow(ctx, sql, args...).Scan(&entityId, &after)
+	if err != nil {
+		return err
+	}
+	return writeAuditEntry(ctx, tx, auditActionCreate, entity, entityId, nil, &after)
+}
+
+// auditUpdate runs an UPDATE ending in RETURNING to_jsonb(<alias>)::text and records the row before
+// and after. An update matching no row, e.g. because of a stale row version, records nothing.
+func auditUpdate(ctx context.Context, tx pgx.Tx, entity string, table string, id interface{}, sql string, args ...interface{}) error {
+	var before string
+	err := tx.QueryRow(ctx, "SELECT to_jsonb(existing)::text FROM public.\""+table+"\" AS existing WHERE \"Id\"=$1 FOR UPDATE", id).Scan(&before)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var after string
+	err = tx.QueryRow(ctx, sql, args...).Scan(&after)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return writeAuditEntry(ctx, tx, auditActionUpdate, entity, fmt.Sprint(id), &before, &after)
+}
+
+// auditDelete runs a DELETE ending in RETURNING <alias>."Id"::text, to_jsonb(<alias>)::text and
+// records the deleted row
+func auditDelete(ctx context.Context, tx pgx.Tx, entity string, sql string, args ...interface{}) error {
+	var entityId, before string
+	err := tx.QueryRow(ctx, sql, args...).Scan(&entityId, &before)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return writeAuditEntry(ctx, tx, auditActionDelete, entity, entityId, &before, nil)
+}
+
+const auditColumns = "\"Id\", \"Time\", \"RequestId\", \"Subject\", \"Issuer\", \"Action\", \"Entity\", \"EntityId\", \"Before\", \"After\", \"PrevHash\", \"Hash\""
+
+func scanAuditEntry(row pgx.Row) (auditEntry, error) {
+	var entry auditEntry
+	err := row.Scan(&entry.Id, &entry.Time, &entry.RequestId, &entry.Subject, &entry.Issuer, &entry.Action, &entry.Entity, &entry.EntityId, &entry.Before, &entry.After, &entry.PrevHash, &entry.Hash)
+	return entry, err
+}
+
+// auditQuery builds the query of the entries matching the filter, oldest first
+func auditQuery(filter auditFilter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, strings.Replace(condition, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+
+	if len(filter.Entity) > 0 {
+		addCondition("\"Entity\" = ?", filter.Entity)
+	}
+	if len(filter.EntityId) > 0 {
+		addCondition("\"EntityId\" = ?", filter.EntityId)
+	}
+	if len(filter.Action) > 0 {
+		addCondition("\"Action\" = ?", filter.Action)
+	}
+	if len(filter.Subject) > 0 {
+		addCondition("\"Subject\" = ?", filter.Subject)
+	}
+	if len(filter.RequestId) > 0 {
+		addCondition("\"RequestId\" = ?", filter.RequestId)
+	}
+	if filter.From != nil {
+		addCondition("\"Time\" >= ?", *filter.From)
+	}
+	if filter.Until != nil {
+		addCondition("\"Time\" < ?", *filter.Until)
+	}
+	if filter.AfterId > 0 {
+		addCondition("\"Id\" > ?", filter.AfterId)
+	}
+
+	query := "SELECT " + auditColumns + " FROM public.\"AuditLog\""
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY \"Id\""
+	if filter.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(filter.Limit)
+	}
+	return query, args
+}
+
+func dbListAuditEntries(ctx context.Context, config config, filter auditFilter) ([]auditEntry, error) {
+	entries := []auditEntry{}
+	err := dbForEachAuditEntry(ctx, config, filter, func(entry auditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// dbForEachAuditEntry streams the matching entries to handle, which is used to export the log
+func dbForEachAuditEntry(ctx context.Context, config config, filter auditFilter, handle func(auditEntry) error) error {
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return err
+	}
+	defer conn.Release()
+
+	query, args := auditQuery(filter)
+	rows, err := conn.Query(ctx, query, args...)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			err := fmt.Errorf("Error while executing query")
+			return err
+		}
+		err = handle(entry)
+		if err != nil {
+			return err
+		}
+	}
+	if rows.Err() != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	return nil
+}
+
+// dbVerifyAuditChain recomputes every hash and checks the links between the entries. Removing the
+// latest entries cannot be detected from the chain alone, compare last_hash with a saved value for that.
+func dbVerifyAuditChain(ctx context.Context, config config) (auditVerification, error) {
+	verification := auditVerification{Valid: true}
+	err := dbForEachAuditEntry(ctx, config, auditFilter{}, func(entry auditEntry) error {
+		verification.check(entry)
+		return nil
+	})
+	return verification, err
+}
+
+// check verifies the next entry of the chain, entries have to be checked oldest first
+func (v *auditVerification) check(entry auditEntry) {
+	v.Entries++
+	if v.Valid && (entry.PrevHash != v.LastHash || entry.computeHash() != entry.Hash) {
+		id := entry.Id
+		v.Valid = false
+		v.FirstInvalidId = &id
+	}
+	v.LastHash = entry.Hash
+}
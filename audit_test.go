@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// auditTx stands in for the transaction writeAuditEntry runs in and keeps the AuditLog rows in memory
+type auditTx struct {
+	pgx.Tx
+	entries []auditEntry
+}
+
+func (tx *auditTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	if strings.HasPrefix(sql, "INSERT INTO public.\"AuditLog\"") {
+		tx.entries = append(tx.entries, auditEntry{
+			Id:        int64(len(tx.entries) + 1),
+			Time:      args[0].(time.Time),
+			RequestId: args[1].(string),
+			Subject:   args[2].(string),
+			Issuer:    args[3].(string),
+			Action:    args[4].(string),
+			Entity:    args[5].(string),
+			EntityId:  args[6].(string),
+			Before:    args[7].(*string),
+			After:     args[8].(*string),
+			PrevHash:  args[9].(string),
+			Hash:      args[10].(string),
+		})
+		return pgconn.NewCommandTag("INSERT 0 1"), nil
+	}
+	return pgconn.NewCommandTag("SELECT 1"), nil
+}
+
+func (tx *auditTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	lastHash := ""
+	if len(tx.entries) > 0 {
+		lastHash = tx.entries[len(tx.entries)-1].Hash
+	}
+	return auditRow{value: lastHash}
+}
+
+type auditRow struct {
+	value string
+}
+
+func (r auditRow) Scan(dest ...interface{}) error {
+	*dest[0].(*string) = r.value
+	return nil
+}
+
+func writeTestAuditLog(t *testing.T) []auditEntry {
+	InitializeLogger()
+	tx := &auditTx{}
+
+	ctx, _ := withRequestLog(context.Background(), Logger, "request-1")
+	setRequestIdentity(ctx, "alice", "https://idp.example.org")
+
+	created := `{"Id": 1, "Claim": "read"}`
+	updated := `{"Id": 1, "Claim": "read:all"}`
+	steps := []struct {
+		ctx           context.Context
+		action        string
+		before, after *string
+	}{
+		{ctx, auditActionCreate, nil, &created},
+		{ctx, auditActionUpdate, &created, &updated},
+		{context.Background(), auditActionDelete, &updated, nil},
+	}
+	for _, step := range steps {
+		err := writeAuditEntry(step.ctx, tx, step.action, auditEntityClaim, "1", step.before, step.after)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return tx.entries
+}
+
+func verifyAuditEntries(entries []auditEntry) auditVerification {
+	verification := auditVerification{Valid: true}
+	for _, entry := range entries {
+		verification.check(entry)
+	}
+	return verification
+}
+
+func TestWriteAuditEntry(t *testing.T) {
+	entries := writeTestAuditLog(t)
+	if len(entries) != 3 {
+		t.Fatalf("%d entries written, want 3", len(entries))
+	}
+
+	first := entries[0]
+	if first.RequestId != "request-1" || first.Subject != "alice" || first.Issuer != "https://idp.example.org" {
+		t.Errorf("actor = %q %q %q, want the caller of the request", first.RequestId, first.Subject, first.Issuer)
+	}
+	if first.PrevHash != "" || first.Hash != first.computeHash() {
+		t.Errorf("first entry links to %q with hash %q, want no predecessor and a valid hash", first.PrevHash, first.Hash)
+	}
+	if entries[2].Subject != auditActorSystem || entries[2].RequestId != "" {
+		t.Errorf("actor outside of requests = %q, want %q", entries[2].Subject, auditActorSystem)
+	}
+	for index := 1; index < len(entries); index++ {
+		if entries[index].PrevHash != entries[index-1].Hash {
+			t.Errorf("entry %d links to %q, want %q", entries[index].Id, entries[index].PrevHash, entries[index-1].Hash)
+		}
+	}
+
+	verification := verifyAuditEntries(entries)
+	if !verification.Valid || verification.Entries != 3 || verification.FirstInvalidId != nil || verification.LastHash != entries[2].Hash {
+		t.Errorf("verification = %+v, want a valid chain of 3 entries", verification)
+	}
+}
+
+func TestVerifyAuditChainDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name           string
+		tamper         func([]auditEntry) []auditEntry
+		firstInvalidId int64
+	}{
+		{
+			name: "changed value",
+			tamper: func(entries []auditEntry) []auditEntry {
+				forged := `{"Id": 1, "Claim": "admin"}`
+				entries[1].After = &forged
+				return entries
+			},
+			firstInvalidId: 2,
+		},
+		{
+			name: "changed actor",
+			tamper: func(entries []auditEntry) []auditEntry {
+				entries[0].Subject = "mallory"
+				return entries
+			},
+			firstInvalidId: 1,
+		},
+		{
+			name: "changed entry with recomputed hash",
+			tamper: func(entries []auditEntry) []auditEntry {
+				entries[0].Subject = "mallory"
+				entries[0].Hash = entries[0].computeHash()
+				return entries
+			},
+			firstInvalidId: 2,
+		},
+		{
+			name: "deleted entry",
+			tamper: func(entries []auditEntry) []auditEntry {
+				return append(entries[:1], entries[2:]...)
+			},
+			firstInvalidId: 3,
+		},
+		{
+			name: "reordered entries",
+			tamper: func(entries []auditEntry) []auditEntry {
+				entries[1], entries[2] = entries[2], entries[1]
+				return entries
+			},
+			firstInvalidId: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries := test.tamper(writeTestAuditLog(t))
+
+			verification := verifyAuditEntries(entries)
+			if verification.Valid || verification.FirstInvalidId == nil {
+				t.Fatalf("verification = %+v, want an invalid chain", verification)
+			}
+			if *verification.FirstInvalidId != test.firstInvalidId {
+				t.Errorf("first invalid entry = %d, want %d", *verification.FirstInvalidId, test.firstInvalidId)
+			}
+		})
+	}
+}
+
+func TestAuditEntryJSON(t *testing.T) {
+	entries := writeTestAuditLog(t)
+
+	var exported map[string]interface{}
+	body, err := json.Marshal(entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(body, &exported)
+
+	after, ok := exported["after"].(map[string]interface{})
+	if !ok || after["Claim"] != "read" {
+		t.Errorf("after = %v, want the row as JSON object", exported["after"])
+	}
+	if exported["before"] != nil {
+		t.Errorf("before = %v, want null", exported["before"])
+	}
+	if exported["hash"] != entries[0].Hash || exported["request_id"] != "request-1" {
+		t.Errorf("exported entry = %s", body)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
+	"crypto/subtle"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
@@ -13,14 +15,16 @@ import (
 	"math/big"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"go.opentelemetry.io/otel/codes"
 )
 
 func GetToken(request *http.Request, identityProviderOidURL string) (jwt.Token, error) {
 	if request.Header["Authorization"] == nil {
 		err := fmt.Errorf("AUTHORIZATION header is missing.")
-		Logger.Error(err)
+		requestLogger(request.Context()).Error(err)
 
 		return jwt.Token{}, err
 	}
@@ -32,9 +36,9 @@ func GetToken(request *http.Request, identityProviderOidURL string) (jwt.Token,
 		tokenString = request.Header["Authorization"][0]
 	}
 
-	token, err := parseToken(tokenString, identityProviderOidURL)
+	token, err := parseToken(request.Context(), tokenString, identityProviderOidURL)
 	if err != nil || !token.Valid {
-		Logger.Error("Invalid token. " + err.Error())
+		requestLogger(request.Context()).Error("Invalid token. " + err.Error())
 		err = fmt.Errorf("Invalid token")
 		return token, err
 	}
@@ -45,7 +49,7 @@ func GetToken(request *http.Request, identityProviderOidURL string) (jwt.Token,
 func GetUnverifiedToken(request *http.Request, identityProviderOidURL string) (jwt.Token, error) {
 	if request.Header["Authorization"] == nil {
 		err := fmt.Errorf("AUTHORIZATION header is missing.")
-		Logger.Error(err)
+		requestLogger(request.Context()).Error(err)
 
 		return jwt.Token{}, err
 	}
@@ -57,7 +61,7 @@ func GetUnverifiedToken(request *http.Request, identityProviderOidURL string) (j
 		tokenString = request.Header["Authorization"][0]
 	}
 
-	token, _ := parseToken(tokenString, identityProviderOidURL)
+	token, _ := parseToken(request.Context(), tokenString, identityProviderOidURL)
 
 	return token, nil
 }
@@ -65,7 +69,7 @@ func GetUnverifiedToken(request *http.Request, identityProviderOidURL string) (j
 func VerifyToken(request *http.Request, identityProviderOidURL string) error {
 	if request.Header["Authorization"] == nil {
 		err := fmt.Errorf("AUTHORIZATION header is missing.")
-		Logger.Error(err)
+		requestLogger(request.Context()).Error(err)
 
 		return err
 	}
@@ -77,9 +81,9 @@ func VerifyToken(request *http.Request, identityProviderOidURL string) error {
 		tokenString = request.Header["Authorization"][0]
 	}
 
-	token, err := parseToken(tokenString, identityProviderOidURL)
+	token, err := parseToken(request.Context(), tokenString, identityProviderOidURL)
 	if err != nil || !token.Valid {
-		Logger.Error("Invalid token. " + err.Error())
+		requestLogger(request.Context()).Error("Invalid token. " + err.Error())
 		err = fmt.Errorf("Invalid token")
 		return err
 	}
@@ -87,9 +91,12 @@ func VerifyToken(request *http.Request, identityProviderOidURL string) error {
 	return nil
 }
 
-func parseToken(tokenString string, identityProviderOidURL string) (jwt.Token, error) {
+func parseToken(ctx context.Context, tokenString string, identityProviderOidURL string) (jwt.Token, error) {
+	ctx, span := tracer.Start(ctx, "token.verify")
+	defer span.End()
+
 	tkn, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		key, err := getTokenKey(token, identityProviderOidURL)
+		key, err := getTokenKey(ctx, token, identityProviderOidURL)
 		keyString, _ := json.Marshal(key)
 
 		jwk := map[string]string{}
@@ -135,24 +142,38 @@ func parseToken(tokenString string, identityProviderOidURL string) (jwt.Token, e
 		return keyOrig, nil
 	})
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		if err == jwt.ErrSignatureInvalid {
 			err = fmt.Errorf("Error invalid token signature")
 			return *tkn, err
 		}
-		Logger.Error("ERROR:" + err.Error())
+		requestLogger(ctx).Error("ERROR:" + err.Error())
 		err = fmt.Errorf("Error parsing token")
 		return *tkn, err
 	}
 
+	// Requestor assertions of this service are only meant for policies, never as bearer or subject token
+	if tokenType, _ := tkn.Header["typ"].(string); strings.EqualFold(tokenType, policyAssertionType) {
+		span.SetStatus(codes.Error, "policy assertion used as token")
+		tkn.Valid = false
+		return *tkn, fmt.Errorf("Error policy assertions are not accepted as token")
+	}
+
+	if claims, ok := tkn.Claims.(jwt.MapClaims); ok && tkn.Valid {
+		subject, _ := claims["sub"].(string)
+		issuer, _ := claims["iss"].(string)
+		setRequestIdentity(ctx, subject, issuer)
+	}
+
 	return *tkn, nil
 }
 
-func getTokenKey(token *jwt.Token, identityProviderOidURL string) (map[string]interface{}, error) {
+func getTokenKey(ctx context.Context, token *jwt.Token, identityProviderOidURL string) (map[string]interface{}, error) {
 	emptyResponse := make(map[string]interface{})
 
-	allKeys, err := getAllKeys(identityProviderOidURL)
+	allKeys, err := getAllKeys(ctx, identityProviderOidURL)
 	if err != nil {
-		Logger.Error("ERROR:" + err.Error())
+		requestLogger(ctx).Error("ERROR:" + err.Error())
 		return emptyResponse, err
 	}
 
@@ -167,13 +188,27 @@ func getTokenKey(token *jwt.Token, identityProviderOidURL string) (map[string]in
 	return emptyResponse, err
 }
 
-func getAllKeys(identityProviderOidURL string) (map[string]interface{}, error) {
+func getAllKeys(ctx context.Context, identityProviderOidURL string) (map[string]interface{}, error) {
+	ctx, span := tracer.Start(ctx, "jwks.fetch")
+	start := time.Now()
+	keys, err := fetchAllKeys(ctx, identityProviderOidURL)
+	jwksFetchDuration.Observe(time.Since(start).Seconds())
+	endSpan(span, err)
+	if err != nil {
+		jwksFetches.WithLabelValues("error").Inc()
+	} else {
+		jwksFetches.WithLabelValues("ok").Inc()
+	}
+	return keys, err
+}
+
+func fetchAllKeys(ctx context.Context, identityProviderOidURL string) (map[string]interface{}, error) {
 	var resp *http.Response
 	method := "GET"
 	emptyResponse := make(map[string]interface{})
 	wellKnownURL := identityProviderOidURL + "/.well-known/openid-configuration"
 
-	request, err := http.NewRequest(method, wellKnownURL, strings.NewReader(""))
+	request, err := http.NewRequestWithContext(ctx, method, wellKnownURL, strings.NewReader(""))
 	resp, err = http.DefaultClient.Do(request)
 	if err == nil {
 		if resp.StatusCode == 200 {
@@ -184,7 +219,7 @@ func getAllKeys(identityProviderOidURL string) (map[string]interface{}, error) {
 
 			method = "GET"
 			certsURL := f.(map[string]interface{})["jwks_uri"]
-			request, err := http.NewRequest(method, certsURL.(string), strings.NewReader(""))
+			request, err := http.NewRequestWithContext(ctx, method, certsURL.(string), strings.NewReader(""))
 
 			resp, err = http.DefaultClient.Do(request)
 			if err == nil {
@@ -210,3 +245,24 @@ func getAllKeys(identityProviderOidURL string) (map[string]interface{}, error) {
 		return emptyResponse, err
 	}
 }
+
+// VerifyClientCredentials checks HTTP Basic client credentials against the configured client.
+// Without a configured client every request is rejected.
+func VerifyClientCredentials(request *http.Request, clientId string, clientSecret string) error {
+	if len(clientId) == 0 || len(clientSecret) == 0 {
+		return fmt.Errorf("Client credentials are not configured.")
+	}
+
+	requestClientId, requestClientSecret, ok := request.BasicAuth()
+	if !ok {
+		return fmt.Errorf("AUTHORIZATION header is missing.")
+	}
+
+	idMatches := subtle.ConstantTimeCompare([]byte(requestClientId), []byte(clientId)) == 1
+	secretMatches := subtle.ConstantTimeCompare([]byte(requestClientSecret), []byte(clientSecret)) == 1
+	if !idMatches || !secretMatches {
+		return fmt.Errorf("Invalid client credentials")
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Mapping candidates of a claim resolution only depend on the context and role set, and the context
+// settings only on the context. Both are cached in process and dropped whenever a claim, role,
+// mapping, default claim or context setting is written.
+// Writes notify the other replicas through a Postgres LISTEN/NOTIFY channel.
+const invalidationChannel = "claim_mapping_invalidation"
+
+var resolutionCache = newCandidateCache(0, 0)
+
+type candidateCacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// cachedContextSettings also caches that no settings match a context
+type cachedContextSettings struct {
+	settings contextSettings
+	found    bool
+}
+
+type candidateCache struct {
+	mutex   sync.Mutex
+	maxSize int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+	// generation changes on every invalidation, results loaded before are not stored
+	generation int64
+
+	hits, misses, evictions, invalidations atomic.Int64
+}
+
+type candidateCacheStats struct {
+	Size          int    `json:"size"`
+	MaxSize       int    `json:"max_size"`
+	TTL           string `json:"ttl"`
+	Hits          int64  `json:"hits"`
+	Misses        int64  `json:"misses"`
+	Evictions     int64  `json:"evictions"`
+	Invalidations int64  `json:"invalidations"`
+}
+
+func newCandidateCache(maxSize int, ttl time.Duration) *candidateCache {
+	return &candidateCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func initResolutionCache(config config) {
+	resolutionCache = newCandidateCache(config.resolutionCacheSize, config.resolutionCacheTTL)
+	if resolutionCache.enabled() {
+		go listenForInvalidations(config)
+	}
+}
+
+func (c *candidateCache) enabled() bool {
+	return c.maxSize > 0 && c.ttl > 0
+}
+
+func candidateCacheKey(context string, roles []string) string {
+	sortedRoles := append([]string{}, roles...)
+	sort.Strings(sortedRoles)
+	uniqueRoles := sortedRoles[:0]
+	for i, role := range sortedRoles {
+		if i == 0 || role != sortedRoles[i-1] {
+			uniqueRoles = append(uniqueRoles, role)
+		}
+	}
+	return "candidates\x00" + context + "\x00" + strings.Join(uniqueRoles, "\x00")
+}
+
+func contextSettingsCacheKey(context string) string {
+	return "settings\x00" + context
+}
+
+func (c *candidateCache) get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, found := c.entries[key]
+	if !found {
+		c.misses.Add(1)
+		return nil, false
+	}
+	entry := element.Value.(*candidateCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	c.hits.Add(1)
+	return entry.value, true
+}
+
+func (c *candidateCache) currentGeneration() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.generation
+}
+
+func (c *candidateCache) put(key string, value interface{}, generation int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if element, found := c.entries[key]; found {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+	c.entries[key] = c.order.PushFront(&candidateCacheEntry{
+		key:     key,
+		value:   value,
+		expires: time.Now().Add(c.ttl),
+	})
+
+	for c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*candidateCacheEntry).key)
+		c.evictions.Add(1)
+	}
+}
+
+func (c *candidateCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.generation++
+	c.invalidations.Add(1)
+}
+
+func (c *candidateCache) stats() candidateCacheStats {
+	c.mutex.Lock()
+	size := c.order.Len()
+	c.mutex.Unlock()
+
+	return candidateCacheStats{
+		Size:          size,
+		MaxSize:       c.maxSize,
+		TTL:           c.ttl.String(),
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Evictions:     c.evictions.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+}
+
+// notifyInvalidation drops the caches of all replicas, including this one, once the surrounding
+// transaction (if any) commits
+func notifyInvalidation(ctx context.Context, executor interface {
+	Exec(context.Context, string, ...interface{}) (pgconn.CommandTag, error)
+}) error {
+	_, err := executor.Exec(ctx, "SELECT pg_notify($1, '')", invalidationChannel)
+	return err
+}
+
+// commitWithInvalidation commits the transaction and then drops the local cache without waiting for
+// the notification. Dropping it before the commit would let a concurrent resolution read the old rows
+// and cache them under the new generation.
+func commitWithInvalidation(ctx context.Context, tx pgx.Tx) error {
+	err := tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	resolutionCache.invalidate()
+	return nil
+}
+
+// listContextRolesClaims returns the mapping candidates for a context and role set, from the cache if possible
+func listContextRolesClaims(ctx context.Context, config config, contextId string, roles []string) ([]mappingCandidate, error) {
+	ctx, span := tracer.Start(ctx, "store.list_context_roles_claims", trace.WithAttributes(attribute.String("claim_mapping.context", contextId)))
+	defer span.End()
+
+	if !resolutionCache.enabled() {
+		return dbListContextRolesClaims(ctx, config, contextId, roles)
+	}
+
+	key := candidateCacheKey(contextId, roles)
+	if cached, found := resolutionCache.get(key); found {
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		return cached.([]mappingCandidate), nil
+	}
+	span.SetAttributes(attribute.Bool("cache.hit", false))
+
+	generation := resolutionCache.currentGeneration()
+	candidates, err := dbListContextRolesClaims(ctx, config, contextId, roles)
+	if err != nil {
+		return candidates, err
+	}
+	resolutionCache.put(key, candidates, generation)
+	return candidates, nil
+}
+
+// getContextSettings returns the most specific context settings matching a context, from the cache if possible
+func getContextSettings(ctx context.Context, config config, contextId string) (contextSettings, bool, error) {
+	if !resolutionCache.enabled() {
+		return dbGetContextSettings(ctx, config, contextId)
+	}
+
+	key := contextSettingsCacheKey(contextId)
+	if cached, found := resolutionCache.get(key); found {
+		return cached.(cachedContextSettings).settings, cached.(cachedContextSettings).found, nil
+	}
+
+	generation := resolutionCache.currentGeneration()
+	settings, found, err := dbGetContextSettings(ctx, config, contextId)
+	if err != nil {
+		return settings, found, err
+	}
+	resolutionCache.put(key, cachedContextSettings{settings: settings, found: found}, generation)
+	return settings, found, nil
+}
+
+// listenForInvalidations drops the cache whenever another replica (or this one) wrote to the store.
+// While the listener is disconnected notifications may be lost, so the cache is dropped on reconnect.
+func listenForInvalidations(config config) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := waitForInvalidations(config)
+		Logger.Warn("Cache invalidation listener disconnected. " + err.Error())
+		resolutionCache.invalidate()
+
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func waitForInvalidations(config config) error {
+	conn, err := pgx.Connect(context.Background(), dbUrl(config))
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(context.Background(), "LISTEN "+invalidationChannel)
+	if err != nil {
+		return err
+	}
+	resolutionCache.invalidate()
+
+	for {
+		_, err := conn.WaitForNotification(context.Background())
+		if err != nil {
+			return err
+		}
+		resolutionCache.invalidate()
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+var errCircuitOpen = fmt.Errorf("circuit breaker is open")
+
+// circuitBreaker stops calling a failing endpoint. After failureThreshold consecutive failures the
+// circuit opens and calls fail immediately; once cooldown passed a single trial call is let through,
+// which closes the circuit again on success.
+type circuitBreaker struct {
+	mutex            sync.Mutex
+	name             string
+	failureThreshold int
+	cooldown         time.Duration
+	state            string
+	failures         int
+	openedAt         time.Time
+	trialRunning     bool
+}
+
+func newCircuitBreaker(name string, failureThreshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		name:             name,
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		state:            circuitClosed,
+	}
+}
+
+// allow reports whether a call may be made, and if so must be followed by a call to done
+func (b *circuitBreaker) allow() error {
+	if b.failureThreshold <= 0 {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return errCircuitOpen
+		}
+		b.state = circuitHalfOpen
+		b.trialRunning = true
+		return nil
+	case circuitHalfOpen:
+		if b.trialRunning {
+			return errCircuitOpen
+		}
+		b.trialRunning = true
+		return nil
+	}
+	return nil
+}
+
+func (b *circuitBreaker) done(success bool) {
+	if b.failureThreshold <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trialRunning = false
+	if success {
+		b.state = circuitClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.failureThreshold {
+		if b.state != circuitOpen {
+			Logger.Warn(fmt.Sprintf("Circuit breaker for %s opened after %d failures", b.name, b.failures))
+		}
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// release ends a call without an outcome, e.g. because the caller gave up. A half-open circuit lets
+// the next call through as trial.
+func (b *circuitBreaker) release() {
+	if b.failureThreshold <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.trialRunning = false
+}
+
+func (b *circuitBreaker) currentState() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
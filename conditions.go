@@ -0,0 +1,172 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker"
+)
+
+// Mapping conditions are CEL expressions evaluated against the token payload ("token") and
+// attributes of the request ("request"), e.g. token.acr == "mfa" && token.email.endsWith("@example.org").
+// Conditions are admin input evaluated on every resolution, so their cost is bounded: expressions
+// whose estimated cost exceeds conditionCostLimit are rejected, and evaluations stop once they
+// reach it. Compiled programs are kept in a bounded LRU cache by expression.
+const (
+	conditionCostLimit = 1000000
+	// conditionInputSize is the size assumed for strings, lists and maps of the input when estimating
+	// the cost of an expression
+	conditionInputSize        = 1024
+	conditionProgramCacheSize = 1000
+	// conditionInterruptCheckFrequency is the number of comprehension iterations between checks
+	// whether the resolution was canceled
+	conditionInterruptCheckFrequency = 100
+)
+
+var conditionEnvironment, conditionEnvironmentErr = cel.NewEnv(
+	cel.Variable("token", cel.MapType(cel.StringType, cel.DynType)),
+	cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+)
+
+var conditionPrograms = &conditionProgramCache{entries: make(map[string]*list.Element), order: list.New()}
+
+type conditionProgramCache struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type conditionProgramEntry struct {
+	expression string
+	program    cel.Program
+}
+
+func (c *conditionProgramCache) get(expression string) (cel.Program, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, found := c.entries[expression]
+	if !found {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*conditionProgramEntry).program, true
+}
+
+func (c *conditionProgramCache) put(expression string, program cel.Program) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, found := c.entries[expression]; found {
+		return
+	}
+	c.entries[expression] = c.order.PushFront(&conditionProgramEntry{expression: expression, program: program})
+	for c.order.Len() > conditionProgramCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*conditionProgramEntry).expression)
+	}
+}
+
+// conditionCostEstimator bounds the size of the input, which is unknown when compiling
+type conditionCostEstimator struct{}
+
+func (e conditionCostEstimator) EstimateSize(element checker.AstNode) *checker.SizeEstimate {
+	return &checker.SizeEstimate{Min: 0, Max: conditionInputSize}
+}
+
+func (e conditionCostEstimator) EstimateCallCost(function, overloadId string, target *checker.AstNode, args []checker.AstNode) *checker.CallEstimate {
+	return nil
+}
+
+func compileCondition(expression string) (cel.Program, error) {
+	if program, found := conditionPrograms.get(expression); found {
+		return program, nil
+	}
+	if conditionEnvironmentErr != nil {
+		return nil, conditionEnvironmentErr
+	}
+
+	ast, issues := conditionEnvironment.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, fmt.Errorf("condition must evaluate to a bool, got %v", ast.OutputType())
+	}
+	cost, err := conditionEnvironment.EstimateCost(ast, conditionCostEstimator{})
+	if err != nil {
+		return nil, err
+	}
+	if cost.Max > conditionCostLimit {
+		return nil, fmt.Errorf("condition is too expensive, its estimated cost %d exceeds %d", cost.Max, conditionCostLimit)
+	}
+	program, err := conditionEnvironment.Program(ast,
+		cel.CostLimit(conditionCostLimit),
+		cel.InterruptCheckFrequency(conditionInterruptCheckFrequency),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	conditionPrograms.put(expression, program)
+	return program, nil
+}
+
+func validateCondition(expression string) error {
+	if len(expression) == 0 {
+		return nil
+	}
+	_, err := compileCondition(expression)
+	return err
+}
+
+func evaluateCondition(ctx context.Context, expression string, attributes map[string]interface{}) (bool, error) {
+	if len(expression) == 0 {
+		return true, nil
+	}
+	program, err := compileCondition(expression)
+	if err != nil {
+		return false, err
+	}
+
+	result, _, err := program.ContextEval(ctx, attributes)
+	if err != nil {
+		return false, err
+	}
+	matched, ok := result.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("condition %q did not evaluate to a bool", expression)
+	}
+	return matched, nil
+}
+
+// conditionAttributes builds the variables conditions are evaluated against
+func conditionAttributes(tokenData interface{}, r *http.Request, context string, requestTime time.Time) map[string]interface{} {
+	token, ok := tokenData.(map[string]interface{})
+	if !ok {
+		token = map[string]interface{}{}
+	}
+
+	request := map[string]interface{}{
+		"time":    requestTime,
+		"context": context,
+	}
+	if r != nil {
+		request["method"] = r.Method
+		request["path"] = r.URL.Path
+		request["host"] = r.Host
+		request["remote_addr"] = r.RemoteAddr
+		request["user_agent"] = r.UserAgent()
+	}
+
+	return map[string]interface{}{
+		"token":   token,
+		"request": request,
+	}
+}
@@ -2,15 +2,23 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap/zapcore"
+	"go.yaml.in/yaml/v3"
 )
 
 type ClaimConfig struct {
-	Roles   []string  `json:"roles"`
-	Context string    `json:"context"`
-	Claims  []string  `json:"claims"`
+	Roles   []string  `json:"roles" yaml:"roles"`
+	Context string    `json:"context" yaml:"context"`
+	Claims  []string  `json:"claims" yaml:"claims"`
 }
 
 type config struct {
@@ -19,90 +27,434 @@ type config struct {
 	tokenRolesPath, tokenContextPath string
 	defaultClaims []ClaimConfig
 	pgHost, pgPort, pgUser, pgPassword, pgDB string
+	databaseURL string
+	pgSSLMode, pgSSLRootCert, pgSSLCert, pgSSLKey string
+	pgMaxConns int
+	httpReadTimeout, httpReadHeaderTimeout, httpWriteTimeout, httpIdleTimeout time.Duration
+	httpMaxHeaderBytes int
+	shutdownTimeout time.Duration
+	healthCacheTTL, healthCheckTimeout time.Duration
+	readinessCheckTSA bool
+	logLevel zapcore.Level
+	logFormat string
+	mappingSweepInterval time.Duration
+	tokenExchangeEnabled bool
+	tokenIssuer string
+	tokenLifetime, signingKeyRotation time.Duration
+	signingKeysDir string
+	signingKeysEphemeral bool
+	mapperClientId, mapperClientSecret string
+	resolutionCacheSize int
+	resolutionCacheTTL time.Duration
+	claimsTimeout time.Duration
+	policyConcurrency int
+	tsaURLs map[string]string
+	tsaConnectTimeout, tsaReadTimeout time.Duration
+	tsaMaxRetries int
+	tsaRetryBackoff time.Duration
+	tsaCircuitFailures int
+	tsaCircuitCooldown time.Duration
+	regoBundlesDir string
+	tsaRequestorMode string
+	tsaClientId, tsaClientSecret, tsaTokenURL, tsaScope string
+	tsaClientCertFile, tsaClientKeyFile, tsaCAFile string
+	configWatchInterval time.Duration
+
+	// settings holds the effective value of every setting, for "config print"
+	settings map[string]interface{}
+}
+
+// Settings are read from an optional YAML or JSON config file whose keys are the environment
+// variable names in lower case, e.g. "pg_host" or "default_claims". Environment variables override
+// the file. Policy URLs per context are read from the "tsa_urls" map and TSA_URL_<context> variables.
+const tsaURLPrefix = "TSA_URL_"
+
+// Secrets can also be read from the file named by <setting>_FILE, e.g. PG_PASSWORD_FILE for a
+// Kubernetes secret mount
+const secretFileSuffix = "_FILE"
+
+// secretSettings are never printed in clear text by "config print --redacted"
+var secretSettings = map[string]bool{
+	"PG_PASSWORD":          true,
+	"DATABASE_URL":         true,
+	"MAPPER_CLIENT_SECRET": true,
+	"TSA_CLIENT_SECRET":    true,
 }
 
-func getConfig() (config, error) {
-	port, found := os.LookupEnv("PORT")
-    if !found {
-		err := fmt.Errorf("Environemnt variable \"PORT\" not found")
-		return config{}, err
+var pgSSLModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// configSource resolves settings from the config file and the environment and collects
+// every error, so that all of them are reported together
+type configSource struct {
+	file     map[string]string
+	used     map[string]bool
+	tsaURLs  map[string]string
+	settings map[string]interface{}
+	errs     []error
+}
+
+func newConfigSource(path string) *configSource {
+	source := &configSource{
+		file:     make(map[string]string),
+		used:     make(map[string]bool),
+		tsaURLs:  make(map[string]string),
+		settings: make(map[string]interface{}),
 	}
-	portInt, err := strconv.Atoi(port)
+	if len(path) > 0 {
+		source.readFile(path)
+	}
+	for _, variable := range os.Environ() {
+		name, value, _ := strings.Cut(variable, "=")
+		if strings.HasPrefix(name, tsaURLPrefix) {
+			source.tsaURLs[strings.TrimPrefix(name, tsaURLPrefix)] = value
+		}
+	}
+	return source
+}
+
+func (s *configSource) readFile(path string) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("Config file %s cannot be read: %v", path, err))
+		return
+	}
+
+	// YAML is a superset of JSON, both are parsed the same way
+	var document map[string]interface{}
+	err = yaml.Unmarshal(content, &document)
 	if err != nil {
-		return config{}, err
+		s.errs = append(s.errs, fmt.Errorf("Config file %s is invalid: %v", path, err))
+		return
+	}
+
+	for key, value := range document {
+		name := strings.ToUpper(key)
+		switch typedValue := value.(type) {
+		case nil:
+		case string:
+			s.file[name] = typedValue
+		case map[string]interface{}, []interface{}:
+			if name == "TSA_URLS" {
+				urls, ok := typedValue.(map[string]interface{})
+				if !ok {
+					s.errs = append(s.errs, fmt.Errorf("Setting \"tsa_urls\" must map contexts to URLs"))
+					continue
+				}
+				for context, url := range urls {
+					s.tsaURLs[context] = fmt.Sprint(url)
+				}
+				s.used[name] = true
+				continue
+			}
+			encodedValue, _ := json.Marshal(typedValue)
+			s.file[name] = string(encodedValue)
+		default:
+			s.file[name] = fmt.Sprint(typedValue)
+		}
+	}
+}
+
+func (s *configSource) lookup(name string) (string, bool) {
+	s.used[name] = true
+	value, found := os.LookupEnv(name)
+	if found {
+		return value, true
+	}
+	value, found = s.file[name]
+	if found || !secretSettings[name] {
+		return value, found
 	}
+	return s.lookupSecretFile(name)
+}
 
-	identityProviderOidURL, found := os.LookupEnv("IDENTITY_PROVIDER_OID_URL")
-    if !found {
-		err := fmt.Errorf("Environemnt variable \"IDENTITY_PROVIDER_OID_URL\" not found")
-		return config{}, err
+// lookupSecretFile reads a secret from the file named by its _FILE setting, without the trailing newline
+func (s *configSource) lookupSecretFile(name string) (string, bool) {
+	fileName := name + secretFileSuffix
+	s.used[fileName] = true
+	path, found := os.LookupEnv(fileName)
+	if !found {
+		path, found = s.file[fileName]
+	}
+	if !found {
+		return "", false
 	}
 
-	tokenRolesPath, found := os.LookupEnv("TOKEN_ROLES_PATH")
-    if !found {
-		err := fmt.Errorf("Environemnt variable \"TOKEN_ROLES_PATH\" not found")
-		return config{}, err
+	content, err := os.ReadFile(path)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("Setting \"%s\" is invalid: secret file cannot be read: %v", fileName, err))
+		return "", false
 	}
-	tokenContextPath, found := os.LookupEnv("TOKEN_CONTEXT_PATH")
-    if !found {
-		err := fmt.Errorf("Environemnt variable \"TOKEN_CONTEXT_PATH\" not found")
-		return config{}, err
+	return strings.TrimRight(string(content), "\r\n"), true
+}
+
+func (s *configSource) record(name string, value interface{}) {
+	s.settings[strings.ToLower(name)] = value
+}
+
+func (s *configSource) invalid(name string, reason string) {
+	if len(reason) > 0 {
+		s.errs = append(s.errs, fmt.Errorf("Setting \"%s\" is invalid: %s", name, reason))
+		return
 	}
+	s.errs = append(s.errs, fmt.Errorf("Setting \"%s\" is invalid", name))
+}
 
-	defaultClaims, found := os.LookupEnv("DEFAULT_CLAIMS")
-    if !found {
-		err := fmt.Errorf("Environemnt variable \"DEFAULT_CLAIMS\" not found")
-		return config{}, err
+func (s *configSource) required(name string) string {
+	value, found := s.lookup(name)
+	if !found {
+		s.errs = append(s.errs, fmt.Errorf("Setting \"%s\" not found", name))
 	}
+	s.record(name, value)
+	return value
+}
 
-	pgHost, found := os.LookupEnv("PG_HOST")
-    if !found {
-		err := fmt.Errorf("Environemnt variable \"PG_HOST\" not found")
-		return config{}, err
+func (s *configSource) optional(name string, defaultValue string) string {
+	value, found := s.lookup(name)
+	if !found {
+		value = defaultValue
 	}
-	pgPort, found := os.LookupEnv("PG_PORT")
-    if !found {
-		err := fmt.Errorf("Environemnt variable \"PG_PORT\" not found")
-		return config{}, err
+	s.record(name, value)
+	return value
+}
+
+func (s *configSource) duration(name string, defaultValue time.Duration) time.Duration {
+	value, found := s.lookup(name)
+	if !found {
+		s.record(name, defaultValue.String())
+		return defaultValue
 	}
-	pgUser, found := os.LookupEnv("PG_USER")
-    if !found {
-		err := fmt.Errorf("Environemnt variable \"PG_USER\" not found")
-		return config{}, err
+	s.record(name, value)
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		s.invalid(name, "not a duration")
+		return defaultValue
 	}
-	pgPassword, found := os.LookupEnv("PG_PASSWORD")
-    if !found {
-		err := fmt.Errorf("Environemnt variable \"PG_PASSWORD\" not found")
-		return config{}, err
+	return duration
+}
+
+func (s *configSource) integer(name string, defaultValue int) int {
+	value, found := s.lookup(name)
+	if !found {
+		s.record(name, defaultValue)
+		return defaultValue
 	}
-	pgDB, found := os.LookupEnv("PG_DB")
-    if !found {
-		err := fmt.Errorf("Environemnt variable \"PG_DB\" not found")
-		return config{}, err
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		s.record(name, value)
+		s.invalid(name, "not a positive number")
+		return defaultValue
 	}
+	s.record(name, number)
+	return number
+}
 
-	var claimConfigs []ClaimConfig
-	err = json.Unmarshal([]byte(defaultClaims), &claimConfigs)
+func (s *configSource) boolean(name string, defaultValue bool) bool {
+	value, found := s.lookup(name)
+	if !found {
+		s.record(name, defaultValue)
+		return defaultValue
+	}
+	boolean, err := strconv.ParseBool(value)
 	if err != nil {
-		err := fmt.Errorf("Environemnt variable \"DEFAULT_CLAIMS\" is invalid")
-		return config{}, err
+		s.record(name, value)
+		s.invalid(name, "not true or false")
+		return defaultValue
+	}
+	s.record(name, boolean)
+	return boolean
+}
+
+// unknownSettings reports keys of the config file that are no setting, most likely typos
+func (s *configSource) unknownSettings() {
+	var unknown []string
+	for name := range s.file {
+		if !s.used[name] {
+			unknown = append(unknown, strings.ToLower(name))
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		s.errs = append(s.errs, fmt.Errorf("Config file setting \"%s\" is unknown", name))
+	}
+}
+
+// loadConfig reads and validates the configuration. All problems are returned joined in one error.
+func loadConfig(path string) (config, error) {
+	source := newConfigSource(path)
+
+	portString := source.required("PORT")
+	port, err := strconv.Atoi(portString)
+	if err != nil && len(portString) > 0 {
+		source.invalid("PORT", "not a number")
+	} else if err == nil {
+		source.record("PORT", port)
+	}
+
+	// DATABASE_URL replaces the single connection settings
+	databaseURL := source.optional("DATABASE_URL", "")
+	pgSetting := source.required
+	if len(databaseURL) > 0 {
+		pgSetting = func(name string) string {
+			return source.optional(name, "")
+		}
 	}
 
 	config := config{
-		port: portInt,
-		identityProviderOidURL: identityProviderOidURL,
-		tokenRolesPath: tokenRolesPath, tokenContextPath: tokenContextPath,
-		defaultClaims: claimConfigs,
-		pgHost: pgHost, pgPort: pgPort, pgUser: pgUser, pgPassword: pgPassword, pgDB: pgDB,
+		port: port,
+		identityProviderOidURL: source.required("IDENTITY_PROVIDER_OID_URL"),
+		tokenRolesPath: source.required("TOKEN_ROLES_PATH"),
+		tokenContextPath: source.required("TOKEN_CONTEXT_PATH"),
+		databaseURL: databaseURL,
+		pgHost: pgSetting("PG_HOST"),
+		pgPort: pgSetting("PG_PORT"),
+		pgUser: pgSetting("PG_USER"),
+		pgPassword: pgSetting("PG_PASSWORD"),
+		pgDB: pgSetting("PG_DB"),
+		pgSSLMode: source.optional("PG_SSLMODE", ""),
+		pgSSLRootCert: source.optional("PG_SSLROOTCERT", ""),
+		pgSSLCert: source.optional("PG_SSLCERT", ""),
+		pgSSLKey: source.optional("PG_SSLKEY", ""),
+		pgMaxConns: source.integer("PG_MAX_CONNS", 0),
+		// The write timeout covers the whole request, it has to exceed CLAIMS_TIMEOUT
+		httpReadTimeout: source.duration("HTTP_READ_TIMEOUT", 15*time.Second),
+		httpReadHeaderTimeout: source.duration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		httpWriteTimeout: source.duration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		httpIdleTimeout: source.duration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+		httpMaxHeaderBytes: source.integer("HTTP_MAX_HEADER_BYTES", 64*1024),
+		shutdownTimeout: source.duration("SHUTDOWN_TIMEOUT", 25*time.Second),
+		healthCacheTTL: source.duration("HEALTH_CACHE_TTL", 5*time.Second),
+		healthCheckTimeout: source.duration("HEALTH_CHECK_TIMEOUT", 2*time.Second),
+		readinessCheckTSA: source.boolean("READINESS_CHECK_TSA", false),
+		logFormat: source.optional("LOG_FORMAT", logFormatJSON),
+		mappingSweepInterval: source.duration("MAPPING_SWEEP_INTERVAL", time.Hour),
+		tokenExchangeEnabled: source.boolean("TOKEN_EXCHANGE_ENABLED", false),
+		tokenIssuer: source.optional("TOKEN_ISSUER", ""),
+		tokenLifetime: source.duration("TOKEN_LIFETIME", 5*time.Minute),
+		signingKeysDir: source.optional("SIGNING_KEYS_DIR", ""),
+		// Keys generated in memory differ per replica and are lost on restart, for development only
+		signingKeysEphemeral: source.boolean("SIGNING_KEYS_EPHEMERAL", false),
+		signingKeyRotation: source.duration("SIGNING_KEY_ROTATION", 24*time.Hour),
+		mapperClientId: source.optional("MAPPER_CLIENT_ID", ""),
+		mapperClientSecret: source.optional("MAPPER_CLIENT_SECRET", ""),
+		resolutionCacheSize: source.integer("RESOLUTION_CACHE_SIZE", 1000),
+		resolutionCacheTTL: source.duration("RESOLUTION_CACHE_TTL", 5*time.Minute),
+		claimsTimeout: source.duration("CLAIMS_TIMEOUT", 10*time.Second),
+		policyConcurrency: source.integer("POLICY_CONCURRENCY", 4),
+		tsaConnectTimeout: source.duration("TSA_CONNECT_TIMEOUT", 2*time.Second),
+		tsaReadTimeout: source.duration("TSA_READ_TIMEOUT", 5*time.Second),
+		tsaMaxRetries: source.integer("TSA_MAX_RETRIES", 2),
+		tsaRetryBackoff: source.duration("TSA_RETRY_BACKOFF", 100*time.Millisecond),
+		tsaCircuitFailures: source.integer("TSA_CIRCUIT_FAILURES", 5),
+		tsaCircuitCooldown: source.duration("TSA_CIRCUIT_COOLDOWN", 30*time.Second),
+		regoBundlesDir: source.optional("REGO_BUNDLES_DIR", ""),
+		tsaRequestorMode: source.optional("TSA_REQUESTOR_MODE", requestorModeToken),
+		// Service authentication to the policy services, client credentials and/or mTLS
+		tsaClientId: source.optional("TSA_CLIENT_ID", ""),
+		tsaClientSecret: source.optional("TSA_CLIENT_SECRET", ""),
+		tsaTokenURL: source.optional("TSA_TOKEN_URL", ""),
+		tsaScope: source.optional("TSA_SCOPE", ""),
+		tsaClientCertFile: source.optional("TSA_CLIENT_CERT_FILE", ""),
+		tsaClientKeyFile: source.optional("TSA_CLIENT_KEY_FILE", ""),
+		tsaCAFile: source.optional("TSA_CA_FILE", ""),
+		tsaURLs: source.tsaURLs,
+		configWatchInterval: source.duration("CONFIG_WATCH_INTERVAL", 10*time.Second),
+	}
+
+	if len(config.pgSSLMode) > 0 && !containsString(pgSSLModes, config.pgSSLMode) {
+		source.invalid("PG_SSLMODE", "must be one of "+strings.Join(pgSSLModes, ", "))
+	}
+	if (len(config.pgSSLCert) > 0) != (len(config.pgSSLKey) > 0) {
+		source.errs = append(source.errs, fmt.Errorf("Settings \"PG_SSLCERT\" and \"PG_SSLKEY\" must be set together"))
+	}
+	if len(config.databaseURL) > 0 {
+		// The parse error is not reported, it could contain the password
+		_, err = pgx.ParseConfig(dbUrl(config))
+		if err != nil {
+			source.invalid("DATABASE_URL", "not a valid connection string")
+		}
+	}
+	level, err := zapcore.ParseLevel(source.optional("LOG_LEVEL", "info"))
+	if err != nil {
+		source.invalid("LOG_LEVEL", "must be one of debug, info, warn or error")
+	}
+	config.logLevel = level
+	if config.logFormat != logFormatJSON && config.logFormat != logFormatConsole {
+		source.invalid("LOG_FORMAT", "must be json or console")
+	}
+	if config.httpWriteTimeout > 0 && config.httpWriteTimeout <= config.claimsTimeout {
+		source.invalid("HTTP_WRITE_TIMEOUT", "must exceed CLAIMS_TIMEOUT")
+	}
+	if config.policyConcurrency == 0 {
+		source.invalid("POLICY_CONCURRENCY", "must be at least 1")
+	}
+	if !isValidRequestorMode(config.tsaRequestorMode) {
+		source.invalid("TSA_REQUESTOR_MODE", "must be one of token, attributes or assertion")
+	}
+	if config.requiresSigningKeys() && len(config.signingKeysDir) == 0 && !config.signingKeysEphemeral {
+		source.errs = append(source.errs, fmt.Errorf("Setting \"SIGNING_KEYS_DIR\" not found, it is required with \"TOKEN_EXCHANGE_ENABLED\" or the assertion requestor mode"))
+	}
+	if (config.requiresSigningKeys() || config.hasSigningKeys()) && len(config.tokenIssuer) == 0 {
+		source.errs = append(source.errs, fmt.Errorf("Setting \"TOKEN_ISSUER\" not found, it is required when tokens or assertions are signed"))
+	}
+	if len(config.tsaClientId) > 0 && len(config.tsaTokenURL) == 0 {
+		source.errs = append(source.errs, fmt.Errorf("Setting \"TSA_TOKEN_URL\" not found, it is required with \"TSA_CLIENT_ID\""))
+	}
+	if (len(config.tsaClientCertFile) > 0) != (len(config.tsaClientKeyFile) > 0) {
+		source.errs = append(source.errs, fmt.Errorf("Settings \"TSA_CLIENT_CERT_FILE\" and \"TSA_CLIENT_KEY_FILE\" must be set together"))
+	}
+
+	// Default claims are managed through the API, the setting only seeds them once
+	defaultClaims := source.optional("DEFAULT_CLAIMS", "[]")
+	if len(defaultClaims) == 0 {
+		defaultClaims = "[]"
+	}
+	err = json.Unmarshal([]byte(defaultClaims), &config.defaultClaims)
+	if err != nil {
+		source.invalid("DEFAULT_CLAIMS", "not a JSON array of default claims")
+	}
+	for _, claimConfig := range config.defaultClaims {
+		_, err = parseContextPattern(claimConfig.Context)
+		if err != nil {
+			source.invalid("DEFAULT_CLAIMS", err.Error())
+		}
+	}
+	source.record("DEFAULT_CLAIMS", config.defaultClaims)
+	source.record("TSA_URLS", config.tsaURLs)
+
+	source.unknownSettings()
+	config.settings = source.settings
+
+	return config, errors.Join(source.errs...)
+}
+
+// requiresSigningKeys reports whether tokens or assertions are signed, which every replica has to
+// do with the same keys
+func (c config) requiresSigningKeys() bool {
+	return c.tokenExchangeEnabled || c.tsaRequestorMode == requestorModeAssertion
+}
+
+// hasSigningKeys reports whether keys shared by the replicas or ephemeral keys are configured
+func (c config) hasSigningKeys() bool {
+	return len(c.signingKeysDir) > 0 || c.signingKeysEphemeral
+}
+
+// printable returns the effective settings, with secrets masked if redacted
+func (c config) printable(redacted bool) map[string]interface{} {
+	settings := make(map[string]interface{})
+	for name, value := range c.settings {
+		if redacted && secretSettings[strings.ToUpper(name)] && value != "" {
+			value = "<redacted>"
+		}
+		settings[name] = value
 	}
-	
-	return config, nil
+	return settings
 }
 
-func getContextPolicyURL(context string) (string) {
-	url, found := os.LookupEnv("TSA_URL_" + context)
-    if !found {
-		url, found = os.LookupEnv("TSA_URL_default")
+// getContextPolicyURL reads the policy URL of contexts without settings in the database
+func getContextPolicyURL(config config, context string) (string) {
+	url, found := config.tsaURLs[context]
+	if !found {
+		url, found = config.tsaURLs["default"]
 		if !found {
 			return ""
 		}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// restartSettings only take effect on restart, a reload logs that they changed but keeps them
+var restartSettings = map[string]bool{
+	"port":                     true,
+	"pg_host":                  true,
+	"pg_port":                  true,
+	"pg_user":                  true,
+	"pg_password":              true,
+	"pg_db":                    true,
+	"pg_sslmode":               true,
+	"pg_sslrootcert":           true,
+	"pg_sslcert":               true,
+	"pg_sslkey":                true,
+	"database_url":             true,
+	"pg_max_conns":             true,
+	"http_read_timeout":        true,
+	"http_read_header_timeout": true,
+	"http_write_timeout":       true,
+	"http_idle_timeout":        true,
+	"http_max_header_bytes":    true,
+	"shutdown_timeout":         true,
+	"log_format":               true,
+	"mapping_sweep_interval":   true,
+	"token_exchange_enabled":   true,
+	"signing_keys_dir":         true,
+	"signing_keys_ephemeral":   true,
+	"signing_key_rotation":     true,
+	"resolution_cache_size":    true,
+	"resolution_cache_ttl":     true,
+	"config_watch_interval":    true,
+}
+
+// policyClientSettings rebuild the policy client when they change
+var policyClientSettings = []string{
+	"tsa_connect_timeout", "tsa_read_timeout", "tsa_max_retries", "tsa_retry_backoff",
+	"tsa_circuit_failures", "tsa_circuit_cooldown", "tsa_client_id", "tsa_client_secret",
+	"tsa_token_url", "tsa_scope", "tsa_client_cert_file", "tsa_client_key_file", "tsa_ca_file",
+}
+
+// watchConfig reloads the configuration on SIGHUP and whenever the content of the config file
+// changes. The file is polled, which also follows the symlink swaps of Kubernetes config maps.
+func watchConfig(s *server, path string, interval time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	var ticks <-chan time.Time
+	if len(path) > 0 && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	fileHash := configFileHash(path)
+	for {
+		select {
+		case <-signals:
+			Logger.Info("Received SIGHUP, reloading configuration")
+			fileHash = configFileHash(path)
+			s.reloadConfig(path)
+		case <-ticks:
+			currentHash := configFileHash(path)
+			if currentHash == nil || bytes.Equal(currentHash, fileHash) {
+				continue
+			}
+			fileHash = currentHash
+			Logger.Info("Config file changed, reloading configuration")
+			s.reloadConfig(path)
+		}
+	}
+}
+
+func configFileHash(path string) []byte {
+	if len(path) == 0 {
+		return nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	hash := sha256.Sum256(content)
+	return hash[:]
+}
+
+// reloadConfig swaps in the new configuration if it is valid, an invalid one is rejected and the
+// current configuration stays in place
+func (s *server) reloadConfig(path string) {
+	newConfig, err := loadConfig(path)
+	if err != nil {
+		Logger.Error("Rejected configuration reload, keeping the current configuration. " + err.Error())
+		return
+	}
+
+	// Rego bundles are read again on their next use, a SIGHUP reloads them even without config changes
+	clearRegoQueries()
+
+	oldConfig := s.currentConfig()
+	changes := configChanges(oldConfig, newConfig)
+	if len(changes) == 0 {
+		Logger.Info("Configuration reloaded without changes")
+		return
+	}
+
+	rebuildPolicyClient := false
+	for _, name := range policyClientSettings {
+		if _, changed := changes[name]; changed {
+			rebuildPolicyClient = true
+		}
+	}
+	if rebuildPolicyClient {
+		err = initTSAClient(newConfig)
+		if err != nil {
+			Logger.Error("Rejected configuration reload, keeping the current configuration. " + err.Error())
+			return
+		}
+	}
+
+	s.config.Store(&newConfig)
+	logLevel.SetLevel(newConfig.logLevel)
+
+	var names []string
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		message := "Configuration changed: " + name + " " + changes[name]
+		if restartSettings[name] {
+			message += " (takes effect on restart)"
+		}
+		Logger.Info(message)
+	}
+
+	if _, changed := changes["default_claims"]; changed {
+		reloadDefaultClaims(newConfig)
+	}
+}
+
+// reloadDefaultClaims seeds the changed DEFAULT_CLAIMS if the default claims were never seeded,
+// afterwards they are only managed through the API
+func reloadDefaultClaims(config config) {
+	if len(config.defaultClaims) == 0 {
+		return
+	}
+	seeded, err := seedDefaultClaims(context.Background(), config)
+	if err != nil {
+		Logger.Error(err)
+		return
+	}
+	if seeded {
+		Logger.Info("Seeded default claims from DEFAULT_CLAIMS")
+		return
+	}
+	Logger.Warn("Setting \"DEFAULT_CLAIMS\" is ignored, the default claims were already seeded and are managed through /list/defaults")
+}
+
+// configChanges describes every changed setting as "old -> new", secrets only as "changed"
+func configChanges(oldConfig config, newConfig config) map[string]string {
+	oldSettings := oldConfig.printable(false)
+	newSettings := newConfig.printable(false)
+
+	changes := make(map[string]string)
+	for name, newValue := range newSettings {
+		oldValue := oldSettings[name]
+		if settingString(oldValue) == settingString(newValue) {
+			continue
+		}
+		if secretSettings[strings.ToUpper(name)] {
+			changes[name] = "changed"
+			continue
+		}
+		changes[name] = settingString(oldValue) + " -> " + settingString(newValue)
+	}
+	return changes
+}
+
+func settingString(value interface{}) string {
+	switch typedValue := value.(type) {
+	case string:
+		return fmt.Sprintf("%q", typedValue)
+	case nil:
+		return "unset"
+	}
+	encodedValue, _ := json.Marshal(value)
+	return string(encodedValue)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Contexts are hierarchical, segments are separated by "/" (e.g. federation/participant/department).
+// A mapping context is either
+//   - an exact context:  "fed/participant/dept"
+//   - a subtree:         "fed/participant/**" (the context itself and all descendants)
+//   - a glob pattern:    "fed/*/dept", "fed/part?er/**" ("*" and "?" never match "/")
+//   - the global "*":    every context
+const contextSeparator = "/"
+
+// Precedence between mappings matching the same context: exact > pattern > global.
+// Patterns with more literal leading segments are more specific.
+const (
+	contextPrecedenceGlobal  = 0
+	contextPrecedencePattern = 100
+	contextPrecedenceExact   = 1000
+)
+
+type contextPattern struct {
+	Pattern    string
+	Prefix     string
+	Regex      string
+	Precedence int
+}
+
+func parseContextPattern(pattern string) (contextPattern, error) {
+	if len(pattern) == 0 {
+		return contextPattern{}, fmt.Errorf("context must not be empty")
+	}
+	if pattern == "*" || pattern == "**" {
+		return contextPattern{Pattern: pattern, Prefix: "", Regex: "^.*$", Precedence: contextPrecedenceGlobal}, nil
+	}
+
+	segments := strings.Split(pattern, contextSeparator)
+	var prefix []string
+	var regex []string
+	literal := true
+	subtree := false
+	for i, segment := range segments {
+		if len(segment) == 0 {
+			return contextPattern{}, fmt.Errorf("context %q contains an empty segment", pattern)
+		}
+		if segment == "**" {
+			if i != len(segments)-1 {
+				return contextPattern{}, fmt.Errorf("context %q: \"**\" is only allowed as last segment", pattern)
+			}
+			subtree = true
+			break
+		}
+		if strings.Contains(segment, "**") {
+			return contextPattern{}, fmt.Errorf("context %q: \"**\" must be a segment on its own", pattern)
+		}
+
+		if strings.ContainsAny(segment, "*?") {
+			literal = false
+			var segmentRegex strings.Builder
+			for _, char := range segment {
+				switch char {
+				case '*':
+					segmentRegex.WriteString("[^/]*")
+				case '?':
+					segmentRegex.WriteString("[^/]")
+				default:
+					segmentRegex.WriteString(regexp.QuoteMeta(string(char)))
+				}
+			}
+			regex = append(regex, segmentRegex.String())
+		} else {
+			if literal {
+				prefix = append(prefix, segment)
+			}
+			regex = append(regex, regexp.QuoteMeta(segment))
+		}
+	}
+
+	regexString := "^" + strings.Join(regex, contextSeparator)
+	if subtree {
+		regexString += "(/.*)?"
+	}
+	regexString += "$"
+
+	if _, err := regexp.Compile(regexString); err != nil {
+		return contextPattern{}, fmt.Errorf("context %q is invalid: %v", pattern, err)
+	}
+
+	precedence := contextPrecedenceExact
+	if !literal || subtree {
+		precedence = contextPrecedencePattern + len(prefix)
+	}
+
+	return contextPattern{
+		Pattern:    pattern,
+		Prefix:     strings.Join(prefix, contextSeparator),
+		Regex:      regexString,
+		Precedence: precedence,
+	}, nil
+}
+
+// contextAncestors returns every prefix a matching mapping may be indexed under,
+// from the global prefix "" down to the context itself.
+func contextAncestors(context string) []string {
+	ancestors := []string{""}
+	segments := strings.Split(context, contextSeparator)
+	for i := range segments {
+		ancestors = append(ancestors, strings.Join(segments[:i+1], contextSeparator))
+	}
+	return ancestors
+}
+
+func applyContextPattern(m *mapping) error {
+	parsedPattern, err := parseContextPattern(m.Context)
+	if err != nil {
+		return err
+	}
+	m.ContextPrefix = parsedPattern.Prefix
+	m.ContextRegex = parsedPattern.Regex
+	m.ContextPrecedence = int64(parsedPattern.Precedence)
+	return nil
+}
+
+func applyDefaultClaimContextPattern(d *defaultClaim) error {
+	parsedPattern, err := parseContextPattern(d.Context)
+	if err != nil {
+		return err
+	}
+	d.ContextPrefix = parsedPattern.Prefix
+	d.ContextRegex = parsedPattern.Regex
+	d.ContextPrecedence = int64(parsedPattern.Precedence)
+	return nil
+}
+
+func applyContextSettingsPattern(c *contextSettings) error {
+	parsedPattern, err := parseContextPattern(c.Context)
+	if err != nil {
+		return err
+	}
+	c.ContextPrefix = parsedPattern.Prefix
+	c.ContextRegex = parsedPattern.Regex
+	c.ContextPrecedence = int64(parsedPattern.Precedence)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestParseContextPattern(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		prefix     string
+		regex      string
+		precedence int
+		matches    []string
+		misses     []string
+	}{
+		{
+			pattern:    "fed/participant/dept",
+			prefix:     "fed/participant/dept",
+			regex:      `^fed/participant/dept$`,
+			precedence: contextPrecedenceExact,
+			matches:    []string{"fed/participant/dept"},
+			misses:     []string{"fed/participant", "fed/participant/dept/team", "fed/participant/depth"},
+		},
+		{
+			pattern:    "fed/participant/**",
+			prefix:     "fed/participant",
+			regex:      `^fed/participant(/.*)?$`,
+			precedence: contextPrecedencePattern + 2,
+			matches:    []string{"fed/participant", "fed/participant/dept", "fed/participant/dept/team"},
+			misses:     []string{"fed", "fed/participants", "fed/other/dept"},
+		},
+		{
+			pattern:    "fed/*/dept",
+			prefix:     "fed",
+			regex:      `^fed/[^/]*/dept$`,
+			precedence: contextPrecedencePattern + 1,
+			matches:    []string{"fed/participant/dept", "fed/other/dept"},
+			misses:     []string{"fed/a/b/dept", "fed/participant/dept/team"},
+		},
+		{
+			pattern:    "fed/part?er/**",
+			prefix:     "fed",
+			regex:      `^fed/part[^/]er(/.*)?$`,
+			precedence: contextPrecedencePattern + 1,
+			matches:    []string{"fed/partner", "fed/partner/dept"},
+			misses:     []string{"fed/parter", "fed/part/er", "fed/partners"},
+		},
+		{
+			pattern:    "fed.example/*",
+			prefix:     "fed.example",
+			regex:      `^fed\.example/[^/]*$`,
+			precedence: contextPrecedencePattern + 1,
+			matches:    []string{"fed.example/participant"},
+			misses:     []string{"fedxexample/participant", "fed.example"},
+		},
+		{
+			pattern:    "*/participant/dept",
+			prefix:     "",
+			regex:      `^[^/]*/participant/dept$`,
+			precedence: contextPrecedencePattern,
+			matches:    []string{"fed/participant/dept", "other/participant/dept"},
+			misses:     []string{"participant/dept", "a/b/participant/dept"},
+		},
+		{
+			pattern:    "*",
+			prefix:     "",
+			regex:      `^.*$`,
+			precedence: contextPrecedenceGlobal,
+			matches:    []string{"fed", "fed/participant/dept"},
+		},
+		{
+			pattern:    "**",
+			prefix:     "",
+			regex:      `^.*$`,
+			precedence: contextPrecedenceGlobal,
+			matches:    []string{"fed", "fed/participant/dept"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			parsedPattern, err := parseContextPattern(test.pattern)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if parsedPattern.Prefix != test.prefix {
+				t.Errorf("prefix = %q, want %q", parsedPattern.Prefix, test.prefix)
+			}
+			if parsedPattern.Regex != test.regex {
+				t.Errorf("regex = %q, want %q", parsedPattern.Regex, test.regex)
+			}
+			if parsedPattern.Precedence != test.precedence {
+				t.Errorf("precedence = %d, want %d", parsedPattern.Precedence, test.precedence)
+			}
+
+			regex := regexp.MustCompile(parsedPattern.Regex)
+			for _, context := range test.matches {
+				if !regex.MatchString(context) {
+					t.Errorf("%q does not match %q", test.pattern, context)
+				}
+				if !containsString(contextAncestors(context), parsedPattern.Prefix) {
+					t.Errorf("prefix %q is not an ancestor of %q, the mapping would not be found", parsedPattern.Prefix, context)
+				}
+			}
+			for _, context := range test.misses {
+				if regex.MatchString(context) {
+					t.Errorf("%q matches %q", test.pattern, context)
+				}
+			}
+		})
+	}
+}
+
+func TestParseContextPatternErrors(t *testing.T) {
+	for _, pattern := range []string{"", "fed//dept", "/fed", "fed/", "fed/**/dept", "fed/a**", "**/dept"} {
+		t.Run(pattern, func(t *testing.T) {
+			_, err := parseContextPattern(pattern)
+			if err == nil {
+				t.Errorf("pattern %q accepted", pattern)
+			}
+		})
+	}
+}
+
+func TestContextPatternPrecedence(t *testing.T) {
+	// From the most to the least specific, all matching "fed/participant/dept"
+	patterns := []string{"fed/participant/dept", "fed/participant/**", "fed/*/dept", "*/participant/dept", "*"}
+
+	previous := -1
+	for index, pattern := range patterns {
+		parsedPattern, err := parseContextPattern(pattern)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", pattern, err)
+		}
+		if !regexp.MustCompile(parsedPattern.Regex).MatchString("fed/participant/dept") {
+			t.Errorf("%q does not match", pattern)
+		}
+		if index > 0 && parsedPattern.Precedence >= previous {
+			t.Errorf("%q has precedence %d, want less than %q with %d", pattern, parsedPattern.Precedence, patterns[index-1], previous)
+		}
+		previous = parsedPattern.Precedence
+	}
+}
+
+func TestContextAncestors(t *testing.T) {
+	got := contextAncestors("fed/participant/dept")
+	want := []string{"", "fed", "fed/participant", "fed/participant/dept"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ancestors = %q, want %q", got, want)
+	}
+}
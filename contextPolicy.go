@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	contextFailModeOpen   = "open"
+	contextFailModeClosed = "closed"
+)
+
+// contextPolicy is the policy evaluation applied to the claims of a context
+type contextPolicy struct {
+	Evaluator     string
+	URL           string
+	Bundle        string
+	Query         string
+	Timeout       time.Duration
+	FailMode      string
+	RequestorMode string
+}
+
+func (p contextPolicy) configured() bool {
+	if p.Evaluator == policyEvaluatorRego {
+		return len(p.Bundle) > 0 && len(p.Query) > 0
+	}
+	return len(p.URL) > 0
+}
+
+func (p contextPolicy) evaluator(config config) PolicyEvaluator {
+	switch p.Evaluator {
+	case policyEvaluatorOPA:
+		return opaEvaluator{url: p.URL}
+	case policyEvaluatorRego:
+		return regoEvaluator{bundlesDir: config.regoBundlesDir, bundle: p.Bundle, query: p.Query}
+	}
+	return tsaEvaluator{url: p.URL}
+}
+
+// evaluate filters the claims by the context's policy within the policy's timeout
+func (p contextPolicy) evaluate(ctx context.Context, config config, request policyRequest) (policyResult, error) {
+	ctx, span := tracer.Start(ctx, "policy.evaluate", trace.WithAttributes(
+		attribute.String("policy.evaluator", p.Evaluator),
+		attribute.String("claim_mapping.context", request.Context),
+	))
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	result, err := p.evaluator(config).Evaluate(ctx, request)
+	endSpan(span, err)
+	return result, err
+}
+
+func isValidContextFailMode(failMode string) bool {
+	return failMode == contextFailModeOpen || failMode == contextFailModeClosed
+}
+
+// UnmarshalJSON enables the settings and lets them fail closed unless the payload says otherwise
+func (c *contextSettings) UnmarshalJSON(data []byte) error {
+	type plainContextSettings contextSettings
+	settings := plainContextSettings{Enabled: true, FailMode: contextFailModeClosed, Evaluator: policyEvaluatorTSA}
+	err := json.Unmarshal(data, &settings)
+	if err != nil {
+		return err
+	}
+	*c = contextSettings(settings)
+	return nil
+}
+
+// validateContextSettings checks the settings and indexes their context pattern
+func validateContextSettings(config config, settings *contextSettings) error {
+	err := applyContextSettingsPattern(settings)
+	if err != nil {
+		return fmt.Errorf("Invalid parameter \"context\": %v", err)
+	}
+	if !isValidPolicyEvaluator(settings.Evaluator) {
+		return fmt.Errorf("Invalid parameter \"evaluator\"")
+	}
+	if len(settings.RequestorMode) > 0 && !isValidRequestorMode(settings.RequestorMode) {
+		return fmt.Errorf("Invalid parameter \"requestor_mode\"")
+	}
+	if settings.RequestorMode == requestorModeAssertion && !config.hasSigningKeys() {
+		return fmt.Errorf("Invalid parameter \"requestor_mode\", assertions require SIGNING_KEYS_DIR or SIGNING_KEYS_EPHEMERAL")
+	}
+	if len(settings.Bundle) > 0 && !filepath.IsLocal(settings.Bundle) {
+		return fmt.Errorf("Invalid parameter \"bundle\", must be a path within the bundles directory")
+	}
+	if settings.Evaluator == policyEvaluatorRego && len(settings.Bundle) > 0 && len(settings.Query) == 0 {
+		return fmt.Errorf("Missing parameter \"query\"")
+	}
+	if len(settings.PolicyURL) > 0 {
+		policyURL, err := url.Parse(settings.PolicyURL)
+		if err != nil || (policyURL.Scheme != "http" && policyURL.Scheme != "https") || len(policyURL.Host) == 0 {
+			return fmt.Errorf("Invalid parameter \"policy_url\"")
+		}
+	}
+	if settings.TimeoutMs < 0 {
+		return fmt.Errorf("Invalid parameter \"timeout_ms\"")
+	}
+	if !isValidContextFailMode(settings.FailMode) {
+		return fmt.Errorf("Invalid parameter \"fail_mode\"")
+	}
+	return nil
+}
+
+// getContextPolicy returns the policy of the most specific context settings matching the context.
+// Without settings the TSA_URL_<context> and TSA_URL_default environment variables apply.
+// Disabled settings switch the policy evaluation off for their contexts.
+func getContextPolicy(ctx context.Context, config config, contextId string) (contextPolicy, error) {
+	settings, found, err := getContextSettings(ctx, config, contextId)
+	if err != nil {
+		return contextPolicy{}, err
+	}
+	if !found {
+		return contextPolicy{Evaluator: policyEvaluatorTSA, URL: getContextPolicyURL(config, contextId), FailMode: contextFailModeClosed, RequestorMode: config.tsaRequestorMode}, nil
+	}
+	if !settings.Enabled {
+		return contextPolicy{FailMode: settings.FailMode}, nil
+	}
+	requestorMode := settings.RequestorMode
+	if len(requestorMode) == 0 {
+		requestorMode = config.tsaRequestorMode
+	}
+
+	return contextPolicy{
+		Evaluator:     settings.Evaluator,
+		URL:           settings.PolicyURL,
+		Bundle:        settings.Bundle,
+		Query:         settings.Query,
+		Timeout:       time.Duration(settings.TimeoutMs) * time.Millisecond,
+		FailMode:      settings.FailMode,
+		RequestorMode: requestorMode,
+	}, nil
+}
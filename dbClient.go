@@ -2,19 +2,29 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"strconv"
+	"net"
+	"net/url"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
 )
 
 type claim struct {
 	Id int64 `gorm:"column:Id;primaryKey"`
 	Claim string `gorm:"column:Claim"`
 	RowVer int64 `gorm:"column:RowVer;not null"`
+	Description string `gorm:"column:Description;type:character varying(255);not null;default:''"`
+	Category string `gorm:"column:Category;type:character varying(100);not null;default:''"`
+	Deprecated bool `gorm:"column:Deprecated;not null;default:false"`
+	ValueSchema json.RawMessage `gorm:"column:ValueSchema;type:jsonb"`
+	Value json.RawMessage `gorm:"column:Value;type:jsonb"`
 }
 
 type role struct {
@@ -28,158 +38,465 @@ type contextClaim struct {
 	Claim string
 	RowVer int64
 	Context string
+	Value json.RawMessage
+	Description string
+	Category string
+	Deprecated bool
 }
 
 type mapping struct {
 	Id uuid.UUID `gorm:"column:Id;type:uuid;primaryKey"`
-	Context string `gorm:"column:Context;type:character varying(50);not null"`
+	Context string `gorm:"column:Context;type:character varying(255);not null"`
 	Claim_Id int64 `gorm:"column:Claim_Id;type: bigint REFERENCES \"Claims\"(\"Id\")"`
 	Role_Id int64 `gorm:"column:Role_Id;type: bigint REFERENCES \"Roles\"(\"Id\")"`
 	Name string `gorm:"column:Name;type:character varying(120);not null"`
 	Description string `gorm:"column:Description;type:character varying(120);not null"`
 	RowVer int64 `gorm:"column:RowVer;not null"`
+	ContextPrefix string `json:"-" gorm:"column:ContextPrefix;type:character varying(255);not null;default:'';index:idx_mapping_context_prefix"`
+	ContextRegex string `json:"-" gorm:"column:ContextRegex;type:character varying(1024);not null;default:''"`
+	ContextPrecedence int64 `json:"-" gorm:"column:ContextPrecedence;not null;default:0"`
+	Effect string `gorm:"column:Effect;type:character varying(5);not null;default:'allow'"`
+	ValidFrom *time.Time `gorm:"column:ValidFrom"`
+	ValidUntil *time.Time `gorm:"column:ValidUntil;index:idx_mapping_valid_until"`
+	Condition string `gorm:"column:Condition;type:text;not null;default:''"`
+	Value json.RawMessage `gorm:"column:Value;type:jsonb"`
 }
 
+// archivedMapping is a mapping moved out of "Mapping" by the sweeper once its validity window ended
+type archivedMapping struct {
+	Id uuid.UUID `gorm:"column:Id;type:uuid;primaryKey"`
+	Context string `gorm:"column:Context;type:character varying(255);not null"`
+	Claim_Id int64 `gorm:"column:Claim_Id"`
+	Role_Id int64 `gorm:"column:Role_Id"`
+	Name string `gorm:"column:Name;type:character varying(120);not null"`
+	Description string `gorm:"column:Description;type:character varying(120);not null"`
+	RowVer int64 `gorm:"column:RowVer;not null"`
+	Effect string `gorm:"column:Effect;type:character varying(5);not null"`
+	ValidFrom *time.Time `gorm:"column:ValidFrom"`
+	ValidUntil *time.Time `gorm:"column:ValidUntil"`
+	Condition string `gorm:"column:Condition;type:text;not null;default:''"`
+	Value json.RawMessage `gorm:"column:Value;type:jsonb"`
+	ArchivedAt time.Time `gorm:"column:ArchivedAt;not null"`
+}
+
+// defaultClaim grants its claims to every holder of one of its roles in a matching context,
+// without a mapping per claim and role
+type defaultClaim struct {
+	Id int64 `gorm:"column:Id;primaryKey"`
+	Context string `gorm:"column:Context;type:character varying(255);not null"`
+	Roles []string `gorm:"column:Roles;type:text[];not null"`
+	Claims []string `gorm:"column:Claims;type:text[];not null"`
+	Description string `gorm:"column:Description;type:character varying(255);not null;default:''"`
+	RowVer int64 `gorm:"column:RowVer;not null"`
+	ContextPrefix string `json:"-" gorm:"column:ContextPrefix;type:character varying(255);not null;default:'';index:idx_default_claims_context_prefix"`
+	ContextRegex string `json:"-" gorm:"column:ContextRegex;type:character varying(1024);not null;default:''"`
+	ContextPrecedence int64 `json:"-" gorm:"column:ContextPrecedence;not null;default:0"`
+}
+
+const mappingColumns = "\"Id\", \"Context\", \"Claim_Id\", \"Role_Id\", \"Name\", \"Description\", \"RowVer\", \"Effect\", \"ValidFrom\", \"ValidUntil\", \"Condition\", \"Value\""
+
+const claimColumns = "\"Id\", \"Claim\", \"RowVer\", \"Description\", \"Category\", \"Deprecated\", \"ValueSchema\"::text, \"Value\"::text"
+
+// jsonValue converts a nullable json(b) column scanned as text
+func jsonValue(value *string) json.RawMessage {
+	if value == nil {
+		return nil
+	}
+	return json.RawMessage(*value)
+}
+
+// jsonParameter converts an optional JSON document into a nullable query parameter
+func jsonParameter(value json.RawMessage) interface{} {
+	if len(value) == 0 || string(value) == "null" {
+		return nil
+	}
+	return string(value)
+}
+
+const (
+	mappingEffectAllow = "allow"
+	mappingEffectDeny = "deny"
+)
+
+// contextSettings configures the policy evaluation of the contexts matching its pattern,
+// the most specific settings apply
+type contextSettings struct {
+	Id int64 `gorm:"column:Id;primaryKey"`
+	Context string `gorm:"column:Context;type:character varying(255);not null;uniqueIndex:idx_contexts_context"`
+	Evaluator string `gorm:"column:Evaluator;type:character varying(10);not null;default:'tsa'"`
+	PolicyURL string `gorm:"column:PolicyURL;type:character varying(1024);not null;default:''"`
+	Bundle string `gorm:"column:Bundle;type:character varying(255);not null;default:''"`
+	Query string `gorm:"column:Query;type:character varying(255);not null;default:''"`
+	RequestorMode string `gorm:"column:RequestorMode;type:character varying(10);not null;default:''"`
+	TimeoutMs int64 `gorm:"column:TimeoutMs;not null;default:0"`
+	FailMode string `gorm:"column:FailMode;type:character varying(6);not null;default:'closed'"`
+	Enabled bool `gorm:"column:Enabled;not null;default:true"`
+	Description string `gorm:"column:Description;type:character varying(255);not null;default:''"`
+	RowVer int64 `gorm:"column:RowVer;not null"`
+	ContextPrefix string `json:"-" gorm:"column:ContextPrefix;type:character varying(255);not null;default:'';index:idx_contexts_context_prefix"`
+	ContextRegex string `json:"-" gorm:"column:ContextRegex;type:character varying(1024);not null;default:''"`
+	ContextPrecedence int64 `json:"-" gorm:"column:ContextPrecedence;not null;default:0"`
+}
+
+// mappingCandidate is a mapping or default claim rule matching the context and roles of a claim request,
+// its condition is evaluated during resolution
+type mappingCandidate struct {
+	Claim contextClaim
+	Source string
+	Effect string
+	MappingId uuid.UUID
+	MappingName string
+	// MappingContext is the context pattern of the mapping or default claim rule
+	MappingContext string
+	DefaultClaimId int64
+	Condition string
+	Role string
+	ValidFrom *time.Time
+	ValidUntil *time.Time
+}
+
+// claimDenial records the deny mapping that removed a claim during resolution
+type claimDenial struct {
+	Claim string `json:"claim"`
+	MappingId uuid.UUID `json:"mapping_id"`
+	MappingName string `json:"mapping_name"`
+	MappingContext string `json:"mapping_context"`
+}
+
+
+// dbUrl returns the connection string, DATABASE_URL if set or else built from the single settings with
+// every part escaped. It contains the password and must never be logged.
+func dbUrl(config config) (string) {
+	if len(config.databaseURL) > 0 {
+		return config.databaseURL
+	}
+
+	query := url.Values{}
+	if len(config.pgSSLMode) > 0 {
+		query.Set("sslmode", config.pgSSLMode)
+	}
+	if len(config.pgSSLRootCert) > 0 {
+		query.Set("sslrootcert", config.pgSSLRootCert)
+	}
+	if len(config.pgSSLCert) > 0 {
+		query.Set("sslcert", config.pgSSLCert)
+		query.Set("sslkey", config.pgSSLKey)
+	}
+
+	dbUrl := url.URL{
+		Scheme: "postgres",
+		User: url.UserPassword(config.pgUser, config.pgPassword),
+		Host: net.JoinHostPort(config.pgHost, config.pgPort),
+		Path: "/" + config.pgDB,
+		RawQuery: query.Encode(),
+	}
+	return dbUrl.String()
+}
+
+// dbPool holds the database connections, it is opened at startup and closed on shutdown
+var dbPool *pgxpool.Pool
+
+func initDBPool(config config) error {
+	poolConfig, err := pgxpool.ParseConfig(dbUrl(config))
+	if err != nil {
+		// The parse error is not returned, it could contain the password
+		return fmt.Errorf("Invalid database connection settings")
+	}
+	poolConfig.ConnConfig.Tracer = dbQueryTracer{}
+	if config.pgMaxConns > 0 {
+		poolConfig.MaxConns = int32(config.pgMaxConns)
+	}
+	dbPool, err = pgxpool.NewWithConfig(context.Background(), poolConfig)
+	return err
+}
+
+func closeDBPool() {
+	if dbPool != nil {
+		dbPool.Close()
+	}
+}
 
-func dbUrl(config config) (url string) {
-	dbUrl := "postgres://" + config.pgUser + ":" + config.pgPassword + "@" + config.pgHost + ":" + config.pgPort + "/" + config.pgDB
-	return dbUrl
+func dbConnect(ctx context.Context) (*pgxpool.Conn, error) {
+	if dbPool == nil {
+		return nil, fmt.Errorf("Database pool is not initialized")
+	}
+	return dbPool.Acquire(ctx)
 }
 
-func autoMigrate(config config) (){
-	dsn := "host=" + config.pgHost + " user=" + config.pgUser + " password=" + config.pgPassword + " dbname=" + config.pgDB + " port=" + config.pgPort
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{DisableForeignKeyConstraintWhenMigrating: true})
+// autoMigrate creates and updates the tables, startup is aborted if it fails
+func autoMigrate(config config) (error) {
+	// gorm's own logger is silenced, it would print the open error including the connection string
+	db, err := gorm.Open(postgres.Open(dbUrl(config)), &gorm.Config{DisableForeignKeyConstraintWhenMigrating: true, Logger: gormlogger.Discard})
 	if err != nil {
-		Logger.Error(err)
+		// The open error is not returned, it could contain the connection string
+		err := fmt.Errorf("Unable to connect to database for migration")
+		return err
 	}
 	database, err := db.DB()
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database for migration")
+		return err
+	}
 	defer database.Close()
 
-	db.Table("Claims").AutoMigrate(&claim{})
-	db.Table("Roles").AutoMigrate(&role{})
-	db.Table("Mapping").AutoMigrate(&mapping{})
+	tables := []struct {
+		name  string
+		model interface{}
+	}{
+		{"Claims", &claim{}},
+		{"Roles", &role{}},
+		{"Mapping", &mapping{}},
+		{"MappingArchive", &archivedMapping{}},
+		{"DefaultClaims", &defaultClaim{}},
+		{"Contexts", &contextSettings{}},
+		{"AuditLog", &auditEntry{}},
+	}
+	for _, table := range tables {
+		err = db.Table(table.name).AutoMigrate(table.model)
+		if err != nil {
+			err := fmt.Errorf("Error while migrating table %s", table.name)
+			return err
+		}
+	}
+
+	// Index mappings created before context patterns were introduced
+	var unindexedMappings []mapping
+	db.Table("Mapping").Where("\"ContextRegex\" = ''").Find(&unindexedMappings)
+	for _, unindexedMapping := range unindexedMappings {
+		err := applyContextPattern(&unindexedMapping)
+		if err != nil {
+			Logger.Warn("Mapping " + unindexedMapping.Id.String() + " has an invalid context. " + err.Error())
+			continue
+		}
+		db.Table("Mapping").Where("\"Id\" = ?", unindexedMapping.Id).Updates(map[string]interface{}{
+			"ContextPrefix": unindexedMapping.ContextPrefix,
+			"ContextRegex": unindexedMapping.ContextRegex,
+			"ContextPrecedence": unindexedMapping.ContextPrecedence,
+		})
+	}
+
+	// DEFAULT_CLAIMS only seeds the default claim rules once
+	if len(config.defaultClaims) > 0 {
+		seeded, err := seedDefaultClaims(context.Background(), config)
+		if err != nil {
+			Logger.Error(err)
+		} else if seeded {
+			Logger.Info("Seeded default claims from DEFAULT_CLAIMS")
+		}
+	}
+
+	return nil
 }
 
 // Claims
 
-func dbListClaims(config config) ([]claim, error) {
-	dbUrl := dbUrl(config)
+func dbListClaims(ctx context.Context, config config) ([]claim, error) {
 	claimsArray := []claim{}
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
 		return claimsArray, err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
-	rows, err := conn.Query(context.Background(), "SELECT * FROM public.\"Claims\"")
+	rows, err := conn.Query(ctx, "SELECT " + claimColumns + " FROM public.\"Claims\"")
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
 		return claimsArray, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		values, err := rows.Values()
+		var claim claim
+		var valueSchema, value *string
+		err := rows.Scan(&claim.Id, &claim.Claim, &claim.RowVer, &claim.Description, &claim.Category, &claim.Deprecated, &valueSchema, &value)
 		if err != nil {
 			err := fmt.Errorf("Error while iterating dataset")
 			return claimsArray, err
 		}
 
-		claim := claim{
-			Id: values[0].(int64),
-			Claim: values[1].(string),
-			RowVer: values[2].(int64),
-		}
+		claim.ValueSchema = jsonValue(valueSchema)
+		claim.Value = jsonValue(value)
 		claimsArray = append(claimsArray, claim)
 	}
 
 	return claimsArray, nil
 }
 
-func dbInsertClaims(config config, newClaims []string) (error) {
-	dbUrl := dbUrl(config)
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+func dbInsertClaims(ctx context.Context, config config, newClaims []claim) (error) {
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
 		return err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
-	valuesString := ""
-	for i, claim := range newClaims {
-		if i == 0 {
-			valuesString += "('" + claim + "', 1)"
-		} else {
-			valuesString += ", ('" + claim + "', 1)"
-		}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
 	}
+	defer tx.Rollback(ctx)
 
-	_, err = conn.Query(context.Background(), "INSERT INTO public.\"Claims\" (\"Claim\", \"RowVer\") VALUES " + valuesString)
+	for _, claim := range newClaims {
+		err = auditInsert(ctx, tx, auditEntityClaim, "INSERT INTO public.\"Claims\" AS changed (\"Claim\", \"RowVer\", \"Description\", \"Category\", \"Deprecated\", \"ValueSchema\", \"Value\") VALUES ($1, 1, $2, $3, $4, $5::jsonb, $6::jsonb) RETURNING changed.\"Id\"::text, to_jsonb(changed)::text",
+			claim.Claim, claim.Description, claim.Category, claim.Deprecated, jsonParameter(claim.ValueSchema), jsonParameter(claim.Value))
+		if err != nil {
+			err := fmt.Errorf("Error while executing query")
+			return err
+		}
+	}
 
+	err = notifyInvalidation(ctx, tx)
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
 		return err
 	}
 
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
+
 	return nil
 }
 
-func dbUpdateClaim(config config, updatedClaim claim) (error) {
-	dbUrl := dbUrl(config)
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+func dbUpdateClaim(ctx context.Context, config config, updatedClaim claim) (error) {
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
 		return err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = auditUpdate(ctx, tx, auditEntityClaim, "Claims", updatedClaim.Id, "UPDATE public.\"Claims\" AS changed SET \"Claim\"=$1, \"Description\"=$2, \"Category\"=$3, \"Deprecated\"=$4, \"ValueSchema\"=$5::jsonb, \"Value\"=$6::jsonb, \"RowVer\"=$7 WHERE \"Id\"=$8 AND \"RowVer\"=$9 RETURNING to_jsonb(changed)::text",
+		updatedClaim.Claim, updatedClaim.Description, updatedClaim.Category, updatedClaim.Deprecated, jsonParameter(updatedClaim.ValueSchema), jsonParameter(updatedClaim.Value), updatedClaim.RowVer + 1, updatedClaim.Id, updatedClaim.RowVer)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = validateMappingValues(ctx, tx, updatedClaim)
+	if err != nil {
+		return err
+	}
+
+	err = notifyInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
 
-	idString := strconv.FormatInt(updatedClaim.Id, 10)
-	rowVerString := strconv.FormatInt(updatedClaim.RowVer, 10)
-	newRowVerString := strconv.FormatInt(updatedClaim.RowVer + 1, 10)
+	return nil
+}
+
+// mappingValueError is returned if a value of a mapping does not conform to the value schema of its claim
+type mappingValueError struct {
+	MappingId string
+	Err       error
+}
+
+func (e *mappingValueError) Error() string {
+	return fmt.Sprintf("value of mapping %s: %v", e.MappingId, e.Err)
+}
+
+// validateMappingValues checks the values of the claim's mappings against its value schema. The
+// mappings are locked until the transaction ends, so none can change before the new schema is committed.
+func validateMappingValues(ctx context.Context, tx pgx.Tx, claim claim) (error) {
+	if len(claim.ValueSchema) == 0 || string(claim.ValueSchema) == "null" {
+		return nil
+	}
 
-	_, err = conn.Query(context.Background(), "UPDATE public.\"Claims\" SET \"Claim\"='" + updatedClaim.Claim + "', \"RowVer\"=" + newRowVerString + " WHERE \"Id\"=" + idString + " AND \"RowVer\"=" + rowVerString)
+	rows, err := tx.Query(ctx, "SELECT \"Id\"::text, \"Value\"::text FROM public.\"Mapping\" WHERE \"Claim_Id\"=$1 AND \"Value\" IS NOT NULL FOR SHARE", claim.Id)
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
 		return err
 	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mappingId, value string
+		err := rows.Scan(&mappingId, &value)
+		if err != nil {
+			err := fmt.Errorf("Error while iterating dataset")
+			return err
+		}
+		err = validateClaimValue(claim.ValueSchema, json.RawMessage(value))
+		if err != nil {
+			return &mappingValueError{MappingId: mappingId, Err: err}
+		}
+	}
+	if rows.Err() != nil {
+		err := fmt.Errorf("Error while iterating dataset")
+		return err
+	}
 
 	return nil
 }
 
-func dbDeleteClaim(config config, id int64) (error) {
-	dbUrl := dbUrl(config)
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+func dbDeleteClaim(ctx context.Context, config config, id int64) (error) {
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
 		return err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
 
-	idString := strconv.FormatInt(id, 10)
+	err = auditDelete(ctx, tx, auditEntityClaim, "DELETE FROM public.\"Claims\" AS changed WHERE \"Id\"=$1 RETURNING changed.\"Id\"::text, to_jsonb(changed)::text", id)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
 
-	_, err = conn.Query(context.Background(), "DELETE FROM public.\"Claims\" WHERE \"Id\"=" + idString)
+	err = notifyInvalidation(ctx, tx)
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
 		return err
 	}
 
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
+
 	return nil
 }
 
 
 // Roles
 
-func dbListRoles(config config) ([]role, error) {
-	dbUrl := dbUrl(config)
+func dbListRoles(ctx context.Context, config config) ([]role, error) {
 	rolesArray := []role{}
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
 		return rolesArray, err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
-	rows, err := conn.Query(context.Background(), "SELECT * FROM public.\"Roles\"")
+	rows, err := conn.Query(ctx, "SELECT * FROM public.\"Roles\"")
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
 		return rolesArray, err
@@ -203,17 +520,16 @@ func dbListRoles(config config) ([]role, error) {
 	return rolesArray, nil
 }
 
-func dbListContextRoles(config config, contextId string) ([]role, error) {
-	dbUrl := dbUrl(config)
+func dbListContextRoles(ctx context.Context, config config, contextId string) ([]role, error) {
 	rolesArray := []role{}
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
 		return rolesArray, err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
-	rows, err := conn.Query(context.Background(), "SELECT * FROM public.\"Roles\" where \"Id\" in (SELECT \"Role_Id\" FROM public.\"Mapping\" where \"Context\"='" + contextId + "')")
+	rows, err := conn.Query(ctx, "SELECT \"Id\", \"Role\", \"RowVer\" FROM public.\"Roles\" where \"Id\" in (SELECT \"Role_Id\" FROM public.\"Mapping\" where \"ContextPrefix\" = ANY($1) AND $2 ~ \"ContextRegex\")", contextAncestors(contextId), contextId)
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
 		return rolesArray, err
@@ -237,85 +553,124 @@ func dbListContextRoles(config config, contextId string) ([]role, error) {
 	return rolesArray, nil
 }
 
-func dbInsertRoles(config config, newRoles []string) (error) {
-	dbUrl := dbUrl(config)
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+func dbInsertRoles(ctx context.Context, config config, newRoles []string) (error) {
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
 		return err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
-	valuesString := ""
-	for i, role := range newRoles {
-		if i == 0 {
-			valuesString += "('" + role + "', 1)"
-		} else {
-			valuesString += ", ('" + role + "', 1)"
-		}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
 	}
+	defer tx.Rollback(ctx)
 
-	_, err = conn.Query(context.Background(), "INSERT INTO public.\"Roles\" (\"Role\", \"RowVer\") VALUES " + valuesString)
+	for _, role := range newRoles {
+		err = auditInsert(ctx, tx, auditEntityRole, "INSERT INTO public.\"Roles\" AS changed (\"Role\", \"RowVer\") VALUES ($1, 1) RETURNING changed.\"Id\"::text, to_jsonb(changed)::text", role)
+		if err != nil {
+			err := fmt.Errorf("Error while executing query")
+			return err
+		}
+	}
 
+	err = notifyInvalidation(ctx, tx)
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
 		return err
 	}
 
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
+
 	return nil
 }
 
-func dbUpdateRole(config config, updatedRole role) (error) {
-	dbUrl := dbUrl(config)
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+func dbUpdateRole(ctx context.Context, config config, updatedRole role) (error) {
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
 		return err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
 
-	idString := strconv.FormatInt(updatedRole.Id, 10)
-	rowVerString := strconv.FormatInt(updatedRole.RowVer, 10)
-	newRowVerString := strconv.FormatInt(updatedRole.RowVer + 1, 10)
+	err = auditUpdate(ctx, tx, auditEntityRole, "Roles", updatedRole.Id, "UPDATE public.\"Roles\" AS changed SET \"Role\"=$1, \"RowVer\"=$2 WHERE \"Id\"=$3 AND \"RowVer\"=$4 RETURNING to_jsonb(changed)::text", updatedRole.Role, updatedRole.RowVer + 1, updatedRole.Id, updatedRole.RowVer)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
 
-	_, err = conn.Query(context.Background(), "UPDATE public.\"Roles\" SET \"Role\"='" + updatedRole.Role + "', \"RowVer\"=" + newRowVerString + " WHERE \"Id\"=" + idString + " AND \"RowVer\"=" + rowVerString)
+	err = notifyInvalidation(ctx, tx)
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
 		return err
 	}
 
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
+
 	return nil
 }
 
-func dbDeleteRole(config config, id int64) (error) {
-	dbUrl := dbUrl(config)
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+func dbDeleteRole(ctx context.Context, config config, id int64) (error) {
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
 		return err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
 
-	idString := strconv.FormatInt(id, 10)
+	err = auditDelete(ctx, tx, auditEntityRole, "DELETE FROM public.\"Roles\" AS changed WHERE \"Id\"=$1 RETURNING changed.\"Id\"::text, to_jsonb(changed)::text", id)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
 
-	_, err = conn.Query(context.Background(), "DELETE FROM public.\"Roles\" WHERE \"Id\"=" + idString)
+	err = notifyInvalidation(ctx, tx)
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
 		return err
 	}
 
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
+
 	return nil
 }
 
-func dbListRolesClaims(config config, roles []string) ([]contextClaim, error) {
-	dbUrl := dbUrl(config)
+func dbListRolesClaims(ctx context.Context, config config, roles []string) ([]contextClaim, error) {
 	contextClaimsArray := []contextClaim{}
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
 		return contextClaimsArray, err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
 	rolesString := ""
 	for i, role := range roles {
@@ -326,7 +681,7 @@ func dbListRolesClaims(config config, roles []string) ([]contextClaim, error) {
 		}
 	}
 
-	rows, err := conn.Query(context.Background(), "SELECT public.\"Claims\".\"Id\", public.\"Claims\".\"Claim\", public.\"Claims\".\"RowVer\", public.\"Mapping\".\"Context\" FROM public.\"Claims\" INNER JOIN public.\"Mapping\" ON public.\"Claims\".\"Id\" = public.\"Mapping\".\"Claim_Id\" where public.\"Mapping\".\"Id\" in (SELECT \"Id\" FROM public.\"Mapping\" where \"Role_Id\" in (SELECT \"Id\" FROM public.\"Roles\" where \"Role\" in (" + rolesString + ")))")
+	rows, err := conn.Query(ctx, "SELECT public.\"Claims\".\"Id\", public.\"Claims\".\"Claim\", public.\"Claims\".\"RowVer\", public.\"Mapping\".\"Context\" FROM public.\"Claims\" INNER JOIN public.\"Mapping\" ON public.\"Claims\".\"Id\" = public.\"Mapping\".\"Claim_Id\" where public.\"Mapping\".\"Id\" in (SELECT \"Id\" FROM public.\"Mapping\" where \"Role_Id\" in (SELECT \"Id\" FROM public.\"Roles\" where \"Role\" in (" + rolesString + ")))")
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
 		return contextClaimsArray, err
@@ -351,163 +706,771 @@ func dbListRolesClaims(config config, roles []string) ([]contextClaim, error) {
 	return contextClaimsArray, nil
 }
 
-func dbListContextRolesClaims(config config, contextId string, roles []string) ([]contextClaim, error) {
-	dbUrl := dbUrl(config)
-	contextClaimsArray := []contextClaim{}
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+func dbListContextRolesClaims(ctx context.Context, config config, contextId string, roles []string) ([]mappingCandidate, error) {
+	candidatesArray := []mappingCandidate{}
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
-		return contextClaimsArray, err
+		return candidatesArray, err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
-	rolesString := ""
-	for i, role := range roles {
-		if i == 0 {
-			rolesString += "'" + role + "'"
-		} else {
-			rolesString += ", '" + role + "'"
+	// Mappings are looked up by the indexed prefixes of the context and matched against their pattern,
+	// most specific first. Validity windows are checked at resolution time, so candidates can be cached.
+	rows, err := conn.Query(ctx, "SELECT public.\"Claims\".\"Id\", public.\"Claims\".\"Claim\", public.\"Claims\".\"RowVer\", public.\"Mapping\".\"Effect\", public.\"Mapping\".\"Id\", public.\"Mapping\".\"Name\", public.\"Mapping\".\"Context\", public.\"Mapping\".\"Condition\", public.\"Claims\".\"Description\", public.\"Claims\".\"Category\", public.\"Claims\".\"Deprecated\", COALESCE(public.\"Mapping\".\"Value\", public.\"Claims\".\"Value\")::text, public.\"Roles\".\"Role\", public.\"Mapping\".\"ValidFrom\", public.\"Mapping\".\"ValidUntil\" FROM public.\"Claims\" INNER JOIN public.\"Mapping\" ON public.\"Claims\".\"Id\" = public.\"Mapping\".\"Claim_Id\" INNER JOIN public.\"Roles\" ON public.\"Roles\".\"Id\" = public.\"Mapping\".\"Role_Id\" where public.\"Roles\".\"Role\" = ANY($1) AND public.\"Mapping\".\"ContextPrefix\" = ANY($2) AND $3 ~ public.\"Mapping\".\"ContextRegex\" ORDER BY public.\"Claims\".\"Id\", public.\"Mapping\".\"Effect\", public.\"Mapping\".\"ContextPrecedence\" DESC", roles, contextAncestors(contextId), contextId)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return candidatesArray, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var candidate mappingCandidate
+		var value *string
+		err := rows.Scan(&candidate.Claim.Id, &candidate.Claim.Claim, &candidate.Claim.RowVer, &candidate.Effect, &candidate.MappingId, &candidate.MappingName, &candidate.MappingContext, &candidate.Condition, &candidate.Claim.Description, &candidate.Claim.Category, &candidate.Claim.Deprecated, &value, &candidate.Role, &candidate.ValidFrom, &candidate.ValidUntil)
+		if err != nil {
+			err := fmt.Errorf("Error while iterating dataset")
+			return candidatesArray, err
 		}
+		// A value set on the mapping overrides the claim's default value
+		candidate.Claim.Value = jsonValue(value)
+
+		candidate.Source = claimSourceMapping
+		candidate.Claim.Context = contextId
+		candidatesArray = append(candidatesArray, candidate)
+	}
+	if rows.Err() != nil {
+		err := fmt.Errorf("Error while executing query")
+		return candidatesArray, err
 	}
 
-	rows, err := conn.Query(context.Background(), "SELECT public.\"Claims\".\"Id\", public.\"Claims\".\"Claim\", public.\"Claims\".\"RowVer\", public.\"Mapping\".\"Context\" FROM public.\"Claims\" INNER JOIN public.\"Mapping\" ON public.\"Claims\".\"Id\" = public.\"Mapping\".\"Claim_Id\" where public.\"Claims\".\"Id\" in (SELECT \"Claim_Id\" FROM public.\"Mapping\" where public.\"Mapping\".\"Context\"='" + contextId + "') AND public.\"Mapping\".\"Id\" in (SELECT \"Id\" FROM public.\"Mapping\" where \"Role_Id\" in (SELECT \"Id\" FROM public.\"Roles\" where \"Role\" in (" + rolesString + ")) AND \"Context\"='" + contextId + "')")
+	// Default claim rules follow the mappings, most specific first. Their claims are enriched with
+	// the catalog entry of the same name, if there is one.
+	rows, err = conn.Query(ctx, "SELECT d.\"Id\", d.\"Context\", dc.\"Claim\", COALESCE(c.\"Id\", 0), COALESCE(c.\"RowVer\", 0), COALESCE(c.\"Description\", ''), COALESCE(c.\"Category\", ''), COALESCE(c.\"Deprecated\", false), c.\"Value\"::text, (SELECT r.\"Role\" FROM unnest(d.\"Roles\") AS r(\"Role\") WHERE r.\"Role\" = ANY($1) LIMIT 1) FROM public.\"DefaultClaims\" d CROSS JOIN LATERAL unnest(d.\"Claims\") WITH ORDINALITY AS dc(\"Claim\", \"Position\") LEFT JOIN LATERAL (SELECT * FROM public.\"Claims\" WHERE public.\"Claims\".\"Claim\" = dc.\"Claim\" ORDER BY public.\"Claims\".\"Id\" LIMIT 1) c ON true WHERE d.\"Roles\" && $1 AND d.\"ContextPrefix\" = ANY($2) AND $3 ~ d.\"ContextRegex\" ORDER BY d.\"ContextPrecedence\" DESC, d.\"Id\", dc.\"Position\"", roles, contextAncestors(contextId), contextId)
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
-		return contextClaimsArray, err
+		return candidatesArray, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		values, err := rows.Values()
+		candidate := mappingCandidate{Source: claimSourceDefault, Effect: mappingEffectAllow}
+		var value *string
+		err := rows.Scan(&candidate.DefaultClaimId, &candidate.MappingContext, &candidate.Claim.Claim, &candidate.Claim.Id, &candidate.Claim.RowVer, &candidate.Claim.Description, &candidate.Claim.Category, &candidate.Claim.Deprecated, &value, &candidate.Role)
 		if err != nil {
 			err := fmt.Errorf("Error while iterating dataset")
-			return contextClaimsArray, err
+			return candidatesArray, err
 		}
+		candidate.Claim.Value = jsonValue(value)
 
-		contextClaim := contextClaim{
-			Id: values[0].(int64),
-			Claim: values[1].(string),
-			RowVer: values[2].(int64),
-			Context: values[3].(string),
-		}
-		contextClaimsArray = append(contextClaimsArray, contextClaim)
+		candidate.Claim.Context = contextId
+		candidatesArray = append(candidatesArray, candidate)
+	}
+	if rows.Err() != nil {
+		err := fmt.Errorf("Error while executing query")
+		return candidatesArray, err
 	}
 
-	return contextClaimsArray, nil
+	return candidatesArray, nil
 }
 
 
-// Mappings
+// Default claims
 
-func dbListMappings(config config) ([]mapping, error) {
-	dbUrl := dbUrl(config)
-	mappingsArray := []mapping{}
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+const defaultClaimColumns = "\"Id\", \"Context\", \"Roles\", \"Claims\", \"Description\", \"RowVer\""
+
+func dbListDefaultClaims(ctx context.Context, config config) ([]defaultClaim, error) {
+	defaultClaimsArray := []defaultClaim{}
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
-		return mappingsArray, err
+		return defaultClaimsArray, err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
-	rows, err := conn.Query(context.Background(), "SELECT * FROM public.\"Mapping\"")
+	rows, err := conn.Query(ctx, "SELECT " + defaultClaimColumns + " FROM public.\"DefaultClaims\" ORDER BY \"Id\"")
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
-		return mappingsArray, err
+		return defaultClaimsArray, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		values, err := rows.Values()
+		var defaultClaim defaultClaim
+		err := rows.Scan(&defaultClaim.Id, &defaultClaim.Context, &defaultClaim.Roles, &defaultClaim.Claims, &defaultClaim.Description, &defaultClaim.RowVer)
 		if err != nil {
 			err := fmt.Errorf("Error while iterating dataset")
-			return mappingsArray, err
+			return defaultClaimsArray, err
 		}
+		defaultClaimsArray = append(defaultClaimsArray, defaultClaim)
+	}
+
+	return defaultClaimsArray, nil
+}
 
-		ints := values[0].([16]uint8)
-		bytes := []byte(ints[:])		
-		id, _ := uuid.FromBytes(bytes)
-		
-		mapping := mapping{
-			Id: id,
-			Context: values[1].(string),
-			Claim_Id: values[2].(int64),
-			Role_Id: values[3].(int64),
-			Name: values[4].(string),
-			Description: values[5].(string),
-			RowVer: values[6].(int64),
+func insertDefaultClaims(ctx context.Context, tx pgx.Tx, newDefaultClaims []defaultClaim) (error) {
+	for _, defaultClaim := range newDefaultClaims {
+		err := auditInsert(ctx, tx, auditEntityDefaultClaim, "INSERT INTO public.\"DefaultClaims\" AS changed (\"Context\", \"Roles\", \"Claims\", \"Description\", \"RowVer\", \"ContextPrefix\", \"ContextRegex\", \"ContextPrecedence\") VALUES ($1, $2, $3, $4, 1, $5, $6, $7) RETURNING changed.\"Id\"::text, to_jsonb(changed)::text",
+			defaultClaim.Context, defaultClaim.Roles, defaultClaim.Claims, defaultClaim.Description, defaultClaim.ContextPrefix, defaultClaim.ContextRegex, defaultClaim.ContextPrecedence)
+		if err != nil {
+			err := fmt.Errorf("Error while executing query")
+			return err
 		}
-		mappingsArray = append(mappingsArray, mapping)
 	}
 
-	return mappingsArray, nil
+	err := notifyInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	return nil
 }
 
-func dbInsertMappings(config config, newMappings []mapping) (error) {
-	dbUrl := dbUrl(config)
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+func dbInsertDefaultClaims(ctx context.Context, config config, newDefaultClaims []defaultClaim) (error) {
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
 		return err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
-	valuesString := ""
-	for i, mapping := range newMappings {
-		claimIdString := strconv.FormatInt(mapping.Claim_Id, 10)
-		roleIdString := strconv.FormatInt(mapping.Role_Id, 10)
-		if i == 0 {
-			valuesString += "('" + mapping.Id.String() + "', '" + mapping.Context + "'," + claimIdString + "," + roleIdString + ",'" + mapping.Name + "','" + mapping.Description + "', 1)"
-		} else {
-			valuesString += ", ('" + mapping.Context + "'," + claimIdString + "," + roleIdString + ",'" + mapping.Name + "','" + mapping.Description + "', 1)"
-		}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
 	}
+	defer tx.Rollback(ctx)
 
-	_, err = conn.Query(context.Background(), "INSERT INTO public.\"Mapping\" (\"Id\",\"Context\", \"Claim_Id\", \"Role_Id\", \"Name\", \"Description\", \"RowVer\") VALUES " + valuesString)
+	err = insertDefaultClaims(ctx, tx, newDefaultClaims)
+	if err != nil {
+		return err
+	}
 
+	err = commitWithInvalidation(ctx, tx)
 	if err != nil {
-		err := fmt.Errorf("Error while executing query")
+		err := fmt.Errorf("Error while committing transaction")
 		return err
 	}
 
 	return nil
 }
 
-func dbUpdateMapping(config config, updatedMapping mapping) (error) {
-	dbUrl := dbUrl(config)
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+// seedDefaultClaims seeds the default claim rules configured in DEFAULT_CLAIMS, invalid ones are skipped
+func seedDefaultClaims(ctx context.Context, config config) (bool, error) {
+	var seedClaims []defaultClaim
+	for _, claimConfig := range config.defaultClaims {
+		seedClaim := defaultClaim{
+			Context: claimConfig.Context,
+			Roles: claimConfig.Roles,
+			Claims: claimConfig.Claims,
+			Description: "Seeded from DEFAULT_CLAIMS",
+		}
+		err := applyDefaultClaimContextPattern(&seedClaim)
+		if err != nil {
+			Logger.Warn("Default claim with context " + claimConfig.Context + " is invalid. " + err.Error())
+			continue
+		}
+		seedClaims = append(seedClaims, seedClaim)
+	}
+	return dbSeedDefaultClaims(ctx, config, seedClaims)
+}
+
+// dbSeedDefaultClaims inserts the default claims unless they were seeded or managed before, which the
+// audit log records. Deleting every rule therefore does not bring the seed back. Replicas starting at
+// the same time are serialized by an advisory lock, so the rules are seeded exactly once.
+func dbSeedDefaultClaims(ctx context.Context, config config, seedClaims []defaultClaim) (bool, error) {
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
-		return err
+		return false, err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
-	idString := updatedMapping.Id.String()
-	claimIdString := strconv.FormatInt(updatedMapping.Claim_Id, 10)
-	roleIdString := strconv.FormatInt(updatedMapping.Role_Id, 10)
-	rowVerString := strconv.FormatInt(updatedMapping.RowVer, 10)
-	newRowVerString := strconv.FormatInt(updatedMapping.RowVer + 1, 10)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return false, err
+	}
+	defer tx.Rollback(ctx)
 
-	_, err = conn.Query(context.Background(), "UPDATE public.\"Mapping\" SET \"Name\"='" + updatedMapping.Name + "', \"Description\"='" + updatedMapping.Description + "', \"Context\"='" + updatedMapping.Context + "', \"Claim_Id\"=" + claimIdString + ", \"Role_Id\"=" + roleIdString + ", \"RowVer\"=" + newRowVerString + " WHERE \"Id\"='" + idString + "' AND \"RowVer\"=" + rowVerString)
+	_, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('DefaultClaims'))")
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
-		return err
+		return false, err
 	}
 
-	return nil
+	// Rules created before the audit log existed are still in the table
+	var managed bool
+	err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM public.\"DefaultClaims\") OR EXISTS (SELECT 1 FROM public.\"AuditLog\" WHERE \"Entity\"=$1)", auditEntityDefaultClaim).Scan(&managed)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return false, err
+	}
+	if managed || len(seedClaims) == 0 {
+		return false, nil
+	}
+
+	err = insertDefaultClaims(ctx, tx, seedClaims)
+	if err != nil {
+		return false, err
+	}
+
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return false, err
+	}
+
+	return true, nil
 }
 
-func dbDeleteMapping(config config, id uuid.UUID) (error) {
-	dbUrl := dbUrl(config)
-	conn, err := pgx.Connect(context.Background(), dbUrl)
+func dbUpdateDefaultClaim(ctx context.Context, config config, updatedDefaultClaim defaultClaim) (error) {
+	conn, err := dbConnect(ctx)
 	if err != nil {
 		err := fmt.Errorf("Unable to connect to database: %v\n", err)
 		return err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
 
-	_, err = conn.Query(context.Background(), "DELETE FROM public.\"Mapping\" WHERE \"Id\"='" + id.String() + "'")
+	err = auditUpdate(ctx, tx, auditEntityDefaultClaim, "DefaultClaims", updatedDefaultClaim.Id, "UPDATE public.\"DefaultClaims\" AS changed SET \"Context\"=$1, \"Roles\"=$2, \"Claims\"=$3, \"Description\"=$4, \"ContextPrefix\"=$5, \"ContextRegex\"=$6, \"ContextPrecedence\"=$7, \"RowVer\"=$8 WHERE \"Id\"=$9 AND \"RowVer\"=$10 RETURNING to_jsonb(changed)::text",
+		updatedDefaultClaim.Context, updatedDefaultClaim.Roles, updatedDefaultClaim.Claims, updatedDefaultClaim.Description, updatedDefaultClaim.ContextPrefix, updatedDefaultClaim.ContextRegex, updatedDefaultClaim.ContextPrecedence, updatedDefaultClaim.RowVer + 1, updatedDefaultClaim.Id, updatedDefaultClaim.RowVer)
 	if err != nil {
 		err := fmt.Errorf("Error while executing query")
 		return err
 	}
 
-	return nil
-}
\ No newline at end of file
+	err = notifyInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
+
+	return nil
+}
+
+func dbDeleteDefaultClaim(ctx context.Context, config config, id int64) (error) {
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = auditDelete(ctx, tx, auditEntityDefaultClaim, "DELETE FROM public.\"DefaultClaims\" AS changed WHERE \"Id\"=$1 RETURNING changed.\"Id\"::text, to_jsonb(changed)::text", id)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = notifyInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
+
+	return nil
+}
+
+
+// Contexts
+
+const contextSettingsColumns = "\"Id\", \"Context\", \"Evaluator\", \"PolicyURL\", \"Bundle\", \"Query\", \"RequestorMode\", \"TimeoutMs\", \"FailMode\", \"Enabled\", \"Description\", \"RowVer\""
+
+func scanContextSettings(row pgx.Row) (contextSettings, error) {
+	var settings contextSettings
+	err := row.Scan(&settings.Id, &settings.Context, &settings.Evaluator, &settings.PolicyURL, &settings.Bundle, &settings.Query, &settings.RequestorMode, &settings.TimeoutMs, &settings.FailMode, &settings.Enabled, &settings.Description, &settings.RowVer)
+	return settings, err
+}
+
+func dbListContextSettings(ctx context.Context, config config) ([]contextSettings, error) {
+	contextsArray := []contextSettings{}
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return contextsArray, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT " + contextSettingsColumns + " FROM public.\"Contexts\" ORDER BY \"Context\"")
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return contextsArray, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		settings, err := scanContextSettings(rows)
+		if err != nil {
+			err := fmt.Errorf("Error while iterating dataset")
+			return contextsArray, err
+		}
+		contextsArray = append(contextsArray, settings)
+	}
+
+	return contextsArray, nil
+}
+
+// dbGetContextSettings returns the most specific settings matching the context, if any
+func dbGetContextSettings(ctx context.Context, config config, contextId string) (contextSettings, bool, error) {
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return contextSettings{}, false, err
+	}
+	defer conn.Release()
+
+	row := conn.QueryRow(ctx, "SELECT " + contextSettingsColumns + " FROM public.\"Contexts\" WHERE \"ContextPrefix\" = ANY($1) AND $2 ~ \"ContextRegex\" ORDER BY \"ContextPrecedence\" DESC LIMIT 1", contextAncestors(contextId), contextId)
+	settings, err := scanContextSettings(row)
+	if err == pgx.ErrNoRows {
+		return contextSettings{}, false, nil
+	}
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return contextSettings{}, false, err
+	}
+
+	return settings, true, nil
+}
+
+func dbInsertContextSettings(ctx context.Context, config config, newContexts []contextSettings) (error) {
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, settings := range newContexts {
+		err = auditInsert(ctx, tx, auditEntityContext, "INSERT INTO public.\"Contexts\" AS changed (\"Context\", \"PolicyURL\", \"TimeoutMs\", \"FailMode\", \"Enabled\", \"Description\", \"RowVer\", \"ContextPrefix\", \"ContextRegex\", \"ContextPrecedence\", \"Evaluator\", \"Bundle\", \"Query\", \"RequestorMode\") VALUES ($1, $2, $3, $4, $5, $6, 1, $7, $8, $9, $10, $11, $12, $13) RETURNING changed.\"Id\"::text, to_jsonb(changed)::text",
+			settings.Context, settings.PolicyURL, settings.TimeoutMs, settings.FailMode, settings.Enabled, settings.Description, settings.ContextPrefix, settings.ContextRegex, settings.ContextPrecedence, settings.Evaluator, settings.Bundle, settings.Query, settings.RequestorMode)
+		if err != nil {
+			err := fmt.Errorf("Error while executing query")
+			return err
+		}
+	}
+
+	err = notifyInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
+
+	return nil
+}
+
+func dbUpdateContextSettings(ctx context.Context, config config, updatedContext contextSettings) (error) {
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = auditUpdate(ctx, tx, auditEntityContext, "Contexts", updatedContext.Id, "UPDATE public.\"Contexts\" AS changed SET \"Context\"=$1, \"PolicyURL\"=$2, \"TimeoutMs\"=$3, \"FailMode\"=$4, \"Enabled\"=$5, \"Description\"=$6, \"ContextPrefix\"=$7, \"ContextRegex\"=$8, \"ContextPrecedence\"=$9, \"Evaluator\"=$10, \"Bundle\"=$11, \"Query\"=$12, \"RequestorMode\"=$13, \"RowVer\"=$14 WHERE \"Id\"=$15 AND \"RowVer\"=$16 RETURNING to_jsonb(changed)::text",
+		updatedContext.Context, updatedContext.PolicyURL, updatedContext.TimeoutMs, updatedContext.FailMode, updatedContext.Enabled, updatedContext.Description, updatedContext.ContextPrefix, updatedContext.ContextRegex, updatedContext.ContextPrecedence, updatedContext.Evaluator, updatedContext.Bundle, updatedContext.Query, updatedContext.RequestorMode, updatedContext.RowVer + 1, updatedContext.Id, updatedContext.RowVer)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = notifyInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
+
+	return nil
+}
+
+func dbDeleteContextSettings(ctx context.Context, config config, id int64) (error) {
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = auditDelete(ctx, tx, auditEntityContext, "DELETE FROM public.\"Contexts\" AS changed WHERE \"Id\"=$1 RETURNING changed.\"Id\"::text, to_jsonb(changed)::text", id)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = notifyInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
+
+	return nil
+}
+
+
+// Mappings
+
+func mappingFromValues(values []interface{}) mapping {
+	ints := values[0].([16]uint8)
+	bytes := []byte(ints[:])
+	id, _ := uuid.FromBytes(bytes)
+
+	mapping := mapping{
+		Id: id,
+		Context: values[1].(string),
+		Claim_Id: values[2].(int64),
+		Role_Id: values[3].(int64),
+		Name: values[4].(string),
+		Description: values[5].(string),
+		RowVer: values[6].(int64),
+		Effect: values[7].(string),
+	}
+	if values[8] != nil {
+		validFrom := values[8].(time.Time)
+		mapping.ValidFrom = &validFrom
+	}
+	if values[9] != nil {
+		validUntil := values[9].(time.Time)
+		mapping.ValidUntil = &validUntil
+	}
+	mapping.Condition = values[10].(string)
+	if values[11] != nil {
+		mapping.Value, _ = json.Marshal(values[11])
+	}
+
+	return mapping
+}
+
+func dbListMappings(ctx context.Context, config config) ([]mapping, error) {
+	mappingsArray := []mapping{}
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return mappingsArray, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT " + mappingColumns + " FROM public.\"Mapping\"")
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return mappingsArray, err
+	}
+
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			err := fmt.Errorf("Error while iterating dataset")
+			return mappingsArray, err
+		}
+
+		mappingsArray = append(mappingsArray, mappingFromValues(values))
+	}
+
+	return mappingsArray, nil
+}
+
+func dbGetMapping(ctx context.Context, config config, id uuid.UUID) (mapping, bool, error) {
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return mapping{}, false, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT " + mappingColumns + " FROM public.\"Mapping\" WHERE \"Id\"=$1", id)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return mapping{}, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if rows.Err() != nil {
+			err := fmt.Errorf("Error while executing query")
+			return mapping{}, false, err
+		}
+		return mapping{}, false, nil
+	}
+	values, err := rows.Values()
+	if err != nil {
+		err := fmt.Errorf("Error while iterating dataset")
+		return mapping{}, false, err
+	}
+
+	return mappingFromValues(values), true, nil
+}
+
+func dbListExpiringMappings(ctx context.Context, config config, from time.Time, until time.Time) ([]mapping, error) {
+	mappingsArray := []mapping{}
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return mappingsArray, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT " + mappingColumns + " FROM public.\"Mapping\" WHERE \"ValidUntil\" > $1 AND \"ValidUntil\" <= $2 ORDER BY \"ValidUntil\"", from, until)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return mappingsArray, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			err := fmt.Errorf("Error while iterating dataset")
+			return mappingsArray, err
+		}
+
+		mappingsArray = append(mappingsArray, mappingFromValues(values))
+	}
+
+	return mappingsArray, nil
+}
+
+// dbArchiveExpiredMappings moves all mappings whose validity ended before now into "MappingArchive".
+// Every archived mapping is recorded as deleted by the system in the audit log.
+func dbArchiveExpiredMappings(ctx context.Context, config config, now time.Time) (int64, error) {
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return 0, err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, "WITH expired AS (DELETE FROM public.\"Mapping\" AS changed WHERE \"ValidUntil\" <= $1 RETURNING changed.*), archived AS (INSERT INTO public.\"MappingArchive\" (" + mappingColumns + ", \"ArchivedAt\") SELECT " + mappingColumns + ", $1 FROM expired) SELECT expired.\"Id\"::text, to_jsonb(expired)::text FROM expired", now)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return 0, err
+	}
+	var ids, befores []string
+	for rows.Next() {
+		var id, before string
+		err := rows.Scan(&id, &before)
+		if err != nil {
+			rows.Close()
+			err := fmt.Errorf("Error while iterating dataset")
+			return 0, err
+		}
+		ids = append(ids, id)
+		befores = append(befores, before)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		err := fmt.Errorf("Error while executing query")
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	for index := range ids {
+		err = writeAuditEntry(ctx, tx, auditActionDelete, auditEntityMapping, ids[index], &befores[index], nil)
+		if err != nil {
+			err := fmt.Errorf("Error while executing query")
+			return 0, err
+		}
+	}
+
+	err = notifyInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return 0, err
+	}
+
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return 0, err
+	}
+
+	return int64(len(ids)), nil
+}
+
+func dbInsertMappings(ctx context.Context, config config, newMappings []mapping) (error) {
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, mapping := range newMappings {
+		if mapping.Id == uuid.Nil {
+			mapping.Id = uuid.New()
+		}
+		err = auditInsert(ctx, tx, auditEntityMapping, "INSERT INTO public.\"Mapping\" AS changed (\"Id\", \"Context\", \"Claim_Id\", \"Role_Id\", \"Name\", \"Description\", \"RowVer\", \"ContextPrefix\", \"ContextRegex\", \"ContextPrecedence\", \"Effect\", \"ValidFrom\", \"ValidUntil\", \"Condition\", \"Value\") VALUES ($1, $2, $3, $4, $5, $6, 1, $7, $8, $9, $10, $11, $12, $13, $14::jsonb) RETURNING changed.\"Id\"::text, to_jsonb(changed)::text",
+			mapping.Id, mapping.Context, mapping.Claim_Id, mapping.Role_Id, mapping.Name, mapping.Description, mapping.ContextPrefix, mapping.ContextRegex, mapping.ContextPrecedence, mapping.Effect, mapping.ValidFrom, mapping.ValidUntil, mapping.Condition, jsonParameter(mapping.Value))
+		if err != nil {
+			err := fmt.Errorf("Error while executing query")
+			return err
+		}
+	}
+
+	err = notifyInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
+
+	return nil
+}
+
+func dbUpdateMapping(ctx context.Context, config config, updatedMapping mapping) (error) {
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = auditUpdate(ctx, tx, auditEntityMapping, "Mapping", updatedMapping.Id, "UPDATE public.\"Mapping\" AS changed SET \"Name\"=$1, \"Description\"=$2, \"Context\"=$3, \"Claim_Id\"=$4, \"Role_Id\"=$5, \"ContextPrefix\"=$6, \"ContextRegex\"=$7, \"ContextPrecedence\"=$8, \"Effect\"=$9, \"ValidFrom\"=$10, \"ValidUntil\"=$11, \"Condition\"=$12, \"Value\"=$13::jsonb, \"RowVer\"=$14 WHERE \"Id\"=$15 AND \"RowVer\"=$16 RETURNING to_jsonb(changed)::text",
+		updatedMapping.Name, updatedMapping.Description, updatedMapping.Context, updatedMapping.Claim_Id, updatedMapping.Role_Id, updatedMapping.ContextPrefix, updatedMapping.ContextRegex, updatedMapping.ContextPrecedence, updatedMapping.Effect, updatedMapping.ValidFrom, updatedMapping.ValidUntil, updatedMapping.Condition, jsonParameter(updatedMapping.Value), updatedMapping.RowVer + 1, updatedMapping.Id, updatedMapping.RowVer)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+
+	err = notifyInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
+
+	return nil
+}
+
+func dbDeleteMapping(ctx context.Context, config config, id uuid.UUID) (error) {
+	conn, err := dbConnect(ctx)
+	if err != nil {
+		err := fmt.Errorf("Unable to connect to database: %v\n", err)
+		return err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		err := fmt.Errorf("Error while starting transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = auditDelete(ctx, tx, auditEntityMapping, "DELETE FROM public.\"Mapping\" AS changed WHERE \"Id\"=$1 RETURNING changed.\"Id\"::text, to_jsonb(changed)::text", id)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = notifyInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while executing query")
+		return err
+	}
+
+	err = commitWithInvalidation(ctx, tx)
+	if err != nil {
+		err := fmt.Errorf("Error while committing transaction")
+		return err
+	}
+
+	return nil
+}
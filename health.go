@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Liveness only tells that the process serves requests. Readiness checks the database and the JWKS of
+// the identity provider, and the policy services if READINESS_CHECK_TSA is set. Check results are
+// cached for HEALTH_CACHE_TTL so that probes do not hit the dependencies on every call.
+const (
+	healthUp      = "up"
+	healthDown    = "down"
+	healthSkipped = "skipped"
+)
+
+var health = &healthChecker{startedAt: time.Now()}
+
+// healthCheckFunc returns errHealthCheckSkipped if there is nothing to check
+type healthCheckFunc func(context.Context, config) error
+
+var errHealthCheckSkipped = fmt.Errorf("skipped")
+
+type healthCheck struct {
+	Status     string `json:"status"`
+	Required   bool   `json:"required"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	CheckedAt  string `json:"checked_at"`
+}
+
+type healthReport struct {
+	Status          string                 `json:"status"`
+	StartedAt       string                 `json:"started_at"`
+	Uptime          string                 `json:"uptime"`
+	Checks          map[string]healthCheck `json:"checks"`
+	PolicyCircuits  map[string]string      `json:"policy_circuits"`
+	ResolutionCache candidateCacheStats    `json:"resolution_cache"`
+}
+
+type healthChecker struct {
+	mutex     sync.Mutex
+	startedAt time.Time
+	checkedAt time.Time
+	checks    map[string]healthCheck
+	// running is closed when the checks in progress finished, concurrent probes wait for the same run
+	running chan struct{}
+	// shuttingDown fails readiness so that no new requests are routed to a draining instance
+	shuttingDown atomic.Bool
+}
+
+// currentChecks returns the cached check results, running the checks again once they expired. The
+// checks run with their own timeout, independent of the probe: a probe giving up gets the previous
+// results, and the run still completes and is cached for the next probe.
+func (h *healthChecker) currentChecks(ctx context.Context, config config) (map[string]healthCheck, bool) {
+	h.mutex.Lock()
+	if h.checks == nil || time.Since(h.checkedAt) >= config.healthCacheTTL {
+		if h.running == nil {
+			h.running = make(chan struct{})
+			go h.refresh(config, h.running)
+		}
+		running := h.running
+		h.mutex.Unlock()
+
+		select {
+		case <-running:
+		case <-ctx.Done():
+		}
+		h.mutex.Lock()
+	}
+	defer h.mutex.Unlock()
+
+	// Without any results yet the instance is not ready
+	ready := !h.shuttingDown.Load() && h.checks != nil
+	for _, check := range h.checks {
+		if check.Required && check.Status == healthDown {
+			ready = false
+		}
+	}
+	return h.checks, ready
+}
+
+func (h *healthChecker) refresh(config config, done chan struct{}) {
+	checks := runHealthChecks(context.Background(), config)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.checks = checks
+	h.checkedAt = time.Now()
+	h.running = nil
+	close(done)
+}
+
+func runHealthChecks(ctx context.Context, config config) map[string]healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, config.healthCheckTimeout)
+	defer cancel()
+
+	checks := map[string]healthCheckFunc{
+		"database": checkDatabase,
+		"jwks":     checkJWKS,
+		"policy":   checkPolicyServices,
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]healthCheck)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check healthCheckFunc) {
+			defer wg.Done()
+			result := runHealthCheck(ctx, config, check)
+			result.Required = name != "policy" || config.readinessCheckTSA
+			mutex.Lock()
+			results[name] = result
+			mutex.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+	return results
+}
+
+func runHealthCheck(ctx context.Context, config config, check healthCheckFunc) (result healthCheck) {
+	start := time.Now()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			result.Status = healthDown
+			result.Error = fmt.Sprint(recovered)
+		}
+		result.DurationMs = time.Since(start).Milliseconds()
+		result.CheckedAt = start.UTC().Format(time.RFC3339)
+	}()
+
+	err := check(ctx, config)
+	if err == errHealthCheckSkipped {
+		return healthCheck{Status: healthSkipped}
+	}
+	if err != nil {
+		return healthCheck{Status: healthDown, Error: err.Error()}
+	}
+	return healthCheck{Status: healthUp}
+}
+
+func checkDatabase(ctx context.Context, config config) error {
+	if dbPool == nil {
+		return fmt.Errorf("Database pool is not initialized")
+	}
+	err := dbPool.Ping(ctx)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to database: %v", err)
+	}
+	return nil
+}
+
+func checkJWKS(ctx context.Context, config config) error {
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				result <- fmt.Errorf("Invalid discovery document or JWKS of the identity provider")
+			}
+		}()
+		keys, err := getAllKeys(ctx, config.identityProviderOidURL)
+		if err != nil {
+			result <- err
+			return
+		}
+		keysArray, ok := keys["keys"].([]interface{})
+		if !ok || len(keysArray) == 0 {
+			result <- fmt.Errorf("JWKS of the identity provider contains no keys")
+			return
+		}
+		result <- nil
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("JWKS of the identity provider not fetched in time")
+	}
+}
+
+// checkPolicyServices reports a policy service as reachable if it answers with any HTTP status
+func checkPolicyServices(ctx context.Context, config config) error {
+	urls := policyServiceURLs(ctx, config)
+	if len(urls) == 0 {
+		return errHealthCheckSkipped
+	}
+
+	for _, url := range urls {
+		request, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+		if err != nil {
+			return fmt.Errorf("Invalid policy URL %s", url)
+		}
+		resp, err := tsaClient().httpClient.Do(request)
+		if err != nil {
+			return fmt.Errorf("Policy service %s is unreachable: %v", url, err)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// policyServiceURLs lists the distinct URLs of the configured remote policy services
+func policyServiceURLs(ctx context.Context, config config) []string {
+	unique := make(map[string]bool)
+	for _, url := range config.tsaURLs {
+		unique[url] = true
+	}
+	settingsArray, err := dbListContextSettings(ctx, config)
+	if err == nil {
+		for _, settings := range settingsArray {
+			if settings.Enabled && settings.Evaluator != policyEvaluatorRego && len(settings.PolicyURL) > 0 {
+				unique[settings.PolicyURL] = true
+			}
+		}
+	}
+
+	var urls []string
+	for url := range unique {
+		if len(url) > 0 {
+			urls = append(urls, url)
+		}
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+func livezGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": healthUp})
+}
+
+func (s *server) readyzGet(w http.ResponseWriter, r *http.Request) {
+	_, ready := health.currentChecks(r.Context(), s.currentConfig())
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": healthDown})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": healthUp})
+}
+
+func (s *server) healthGet(w http.ResponseWriter, r *http.Request) {
+	checks, ready := health.currentChecks(r.Context(), s.currentConfig())
+
+	report := healthReport{
+		Status:          healthUp,
+		StartedAt:       health.startedAt.UTC().Format(time.RFC3339),
+		Uptime:          time.Since(health.startedAt).Round(time.Second).String(),
+		Checks:          checks,
+		PolicyCircuits:  tsaClient().circuitStates(),
+		ResolutionCache: resolutionCache.stats(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		report.Status = healthDown
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -1,42 +1,289 @@
 package main
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/yalp/jsonpath"
+)
+
+// contextClaims is the resolution result for one context
+type contextClaims struct {
+	Context       string
+	Claims        []contextClaim
+	Denied        []claimDenial
+	PolicyVersion string
+}
+
+// contextClaimsResponse and claimResponse are the public shape of GET /claims,
+// independent of the database rows
+type contextClaimsResponse struct {
+	Context string          `json:"context"`
+	Claims  []claimResponse `json:"claims"`
+	Denied  []claimDenial   `json:"denied,omitempty"`
+}
+
+type claimResponse struct {
+	Claim       string          `json:"claim"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Category    string          `json:"category,omitempty"`
+	Deprecated  bool            `json:"deprecated,omitempty"`
+}
+
+func (c *contextClaims) response() contextClaimsResponse {
+	response := contextClaimsResponse{
+		Context: c.Context,
+		Claims:  []claimResponse{},
+		Denied:  c.Denied,
+	}
+	for _, claim := range c.Claims {
+		response.Claims = append(response.Claims, claimResponse{
+			Claim:       claim.Claim,
+			Value:       claim.Value,
+			Description: claim.Description,
+			Category:    claim.Category,
+			Deprecated:  claim.Deprecated,
+		})
+	}
+	return response
+}
+
 func hasRole(rolesArray []string, existingRoles []string) bool {
-	hasRole := false
+	_, hasRole := matchingRole(rolesArray, existingRoles)
+	return hasRole
+}
+
+func matchingRole(rolesArray []string, existingRoles []string) (string, bool) {
 	for _, defaultRole := range existingRoles {
 		for _, role := range rolesArray {
 			if defaultRole == role {
-				hasRole = true
+				return role, true
 			}
 		}
 	}
-	return hasRole
+	return "", false
+}
+
+// resolveDefaultCandidates adds the claims of the matching default claim rules which are not granted yet
+func resolveDefaultCandidates(candidates []mappingCandidate, existingClaims *contextClaims) []claimDecision {
+	var decisions []claimDecision
+	for _, candidate := range candidates {
+		if candidate.Source != claimSourceDefault {
+			continue
+		}
+
+		defaultClaimId := candidate.DefaultClaimId
+		decision := claimDecision{
+			Claim:               candidate.Claim.Claim,
+			Source:              claimSourceDefault,
+			DefaultClaimId:      &defaultClaimId,
+			DefaultClaimContext: candidate.MappingContext,
+			Role:                candidate.Role,
+			Outcome:             claimOutcomeGranted,
+		}
+
+		added := false
+		for _, claim := range existingClaims.Claims {
+			if candidate.Claim.Claim == claim.Claim {
+				added = true
+			}
+		}
+		if !added {
+			newClaim := candidate.Claim
+			newClaim.Context = existingClaims.Context
+			existingClaims.Claims = append(existingClaims.Claims, newClaim)
+		} else {
+			decision.Outcome = claimOutcomeShadowed
+			decision.Reason = "claim already granted"
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions
+}
+
+// stringList reads an array of strings from a decoded JSON payload
+func stringList(value interface{}) ([]string, bool) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	strings := []string{}
+	for _, item := range list {
+		itemString, ok := item.(string)
+		if !ok {
+			return nil, false
+		}
+		strings = append(strings, itemString)
+	}
+	return strings, true
+}
+
+func isValidMappingEffect(effect string) bool {
+	return effect == mappingEffectAllow || effect == mappingEffectDeny
+}
+
+// applyDenials removes every claim matched by a deny mapping, regardless of whether it was granted
+// by a mapping or by the default claims, and notes the deny rule that removed it.
+func applyDenials(existingClaims *contextClaims, denials []claimDenial) {
+	if len(denials) == 0 {
+		return
+	}
+
+	remainingClaims := []contextClaim{}
+	for _, claim := range existingClaims.Claims {
+		denied := false
+		for _, denial := range denials {
+			if denial.Claim == claim.Claim {
+				existingClaims.Denied = append(existingClaims.Denied, denial)
+				denied = true
+				break
+			}
+		}
+		if !denied {
+			remainingClaims = append(remainingClaims, claim)
+		}
+	}
+	existingClaims.Claims = remainingClaims
 }
 
-func appendDefaultClaims(currentContext string, defaultClaims []ClaimConfig, existingClaims map[string]interface{}, rolesArray []string) {
-	if len(defaultClaims) > 0 {
-		for _, claimConfig := range defaultClaims {
-			if claimConfig.Context == currentContext || claimConfig.Context == "*" {
-				hasRole := hasRole(rolesArray, claimConfig.Roles)
-				if hasRole {
-					for _, defaultClaim := range claimConfig.Claims {
-						added := false
-						for _, claim := range existingClaims["claims"].([]contextClaim) {
-							if defaultClaim == claim.Claim {
-								added = true
-							}
-						}
-						if !added {
-							newClaim := contextClaim{
-								Id:      0,
-								Claim:   defaultClaim,
-								RowVer:  0,
-								Context: existingClaims["context"].(string),
-							}
-							existingClaims["claims"] = append(existingClaims["claims"].([]contextClaim), newClaim)
-						}
-					}
-				}
+func isValidMappingWindow(validFrom *time.Time, validUntil *time.Time) bool {
+	return validFrom == nil || validUntil == nil || validUntil.After(*validFrom)
+}
+
+// parseOptionalTime parses an optional RFC 3339 timestamp from a decoded JSON payload
+func parseOptionalTime(value interface{}) (*time.Time, error) {
+	if value == nil {
+		return nil, nil
+	}
+	timeString, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid timestamp")
+	}
+	parsedTime, err := time.Parse(time.RFC3339, timeString)
+	if err != nil {
+		return nil, err
+	}
+	return &parsedTime, nil
+}
+
+// optionalJSON re-encodes an optional JSON value from a decoded payload
+func optionalJSON(value interface{}) (json.RawMessage, error) {
+	if value == nil {
+		return nil, nil
+	}
+	return json.Marshal(value)
+}
+
+const claimSchemaURL = "urn:claim-mapping-service:claim-value"
+
+func compileClaimSchema(schema json.RawMessage) (*jsonschema.Schema, error) {
+	document, err := jsonschema.UnmarshalJSON(bytes.NewReader(schema))
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	err = compiler.AddResource(claimSchemaURL, document)
+	if err != nil {
+		return nil, err
+	}
+	return compiler.Compile(claimSchemaURL)
+}
+
+// validateClaimValue checks that schema is a valid JSON schema and value, if any, conforms to it.
+// Without a schema any JSON value is accepted.
+func validateClaimValue(schema json.RawMessage, value json.RawMessage) error {
+	if len(value) > 0 && !json.Valid(value) {
+		return fmt.Errorf("value is not valid JSON")
+	}
+	if len(schema) == 0 || string(schema) == "null" {
+		return nil
+	}
+
+	compiledSchema, err := compileClaimSchema(schema)
+	if err != nil {
+		return fmt.Errorf("invalid value schema: %v", err)
+	}
+	if len(value) == 0 || string(value) == "null" {
+		return nil
+	}
+
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	err = compiledSchema.Validate(instance)
+	if err != nil {
+		return fmt.Errorf("%v", err)
+	}
+	return nil
+}
+
+// tokenPayloadData returns the token's claims as generic JSON data for JSONPath lookups
+func tokenPayloadData(token jwt.Token) interface{} {
+	tokenPayload, _ := json.Marshal(token.Claims.(jwt.MapClaims))
+	var tokenData interface{}
+	json.Unmarshal(tokenPayload, &tokenData)
+	return tokenData
+}
+
+func readTokenRoles(tokenData interface{}, tokenRolesPath string) ([]string, error) {
+	roles, err := jsonpath.Read(tokenData, tokenRolesPath)
+	if err != nil {
+		return nil, err
+	}
+	rolesList, ok := roles.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("roles are not an array")
+	}
+	var rolesArray []string
+	for _, role := range rolesList {
+		roleString, ok := role.(string)
+		if !ok {
+			return nil, fmt.Errorf("role is not a string")
+		}
+		rolesArray = append(rolesArray, roleString)
+	}
+	return rolesArray, nil
+}
+
+// readTokenContexts reads the token's context, either a single context or an array of contexts
+func readTokenContexts(tokenData interface{}, tokenContextPath string) ([]string, error) {
+	tokenContext, err := jsonpath.Read(tokenData, tokenContextPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var contexts []string
+	switch value := tokenContext.(type) {
+	case string:
+		contexts = append(contexts, value)
+	case []interface{}:
+		for _, item := range value {
+			contextString, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("context is not a string")
+			}
+			if !containsString(contexts, contextString) {
+				contexts = append(contexts, contextString)
 			}
 		}
 	}
+	if len(contexts) == 0 {
+		return nil, fmt.Errorf("context is missing")
+	}
+	return contexts, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
 }
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -8,13 +13,144 @@ import (
 )
 
 var Logger *zap.SugaredLogger
+
+// logLevel is shared by all loggers, a configuration reload changes it in place
+var logLevel = zap.NewAtomicLevelAt(zap.InfoLevel)
+
+const (
+	logFormatJSON    = "json"
+	logFormatConsole = "console"
+)
+
 func InitializeLogger() {
-	config := zap.NewProductionConfig()
-	config.EncoderConfig.TimeKey = "timestamp"
-	config.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.RFC3339)
-	config.EncoderConfig.CallerKey = ""
-	config.EncoderConfig.StacktraceKey = ""
-
-	logger, _ := config.Build()
-	Logger = logger.Sugar()
-}
\ No newline at end of file
+	Logger = newLogger(logFormatJSON)
+}
+
+// configureLogger applies LOG_LEVEL and LOG_FORMAT once the configuration is loaded
+func configureLogger(config config) {
+	logLevel.SetLevel(config.logLevel)
+	Logger = newLogger(config.logFormat)
+}
+
+func newLogger(format string) *zap.SugaredLogger {
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.TimeKey = "timestamp"
+	encoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.RFC3339)
+	encoderConfig.CallerKey = ""
+	encoderConfig.StacktraceKey = ""
+
+	var encoder zapcore.Encoder
+	if format == logFormatConsole {
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	} else {
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	}
+
+	core := zapcore.NewCore(encoder, zapcore.Lock(os.Stderr), logLevel)
+	return zap.New(redactingCore{Core: core}).Sugar()
+}
+
+// Bearer tokens and other JWTs never reach the log output, wherever they appear in a message or field
+var tokenPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+
+const redacted = "[REDACTED]"
+
+func redactTokens(text string) string {
+	return tokenPattern.ReplaceAllString(text, redacted)
+}
+
+type redactingCore struct {
+	zapcore.Core
+}
+
+func (c redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactingCore{Core: c.Core.With(redactFields(fields))}
+}
+
+func (c redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = redactTokens(entry.Message)
+	return c.Core.Write(entry, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	redactedFields := make([]zapcore.Field, len(fields))
+	for index, field := range fields {
+		switch field.Type {
+		case zapcore.StringType:
+			field.String = redactTokens(field.String)
+		case zapcore.ErrorType:
+			if err, ok := field.Interface.(error); ok {
+				field = zap.String(field.Key, redactTokens(err.Error()))
+			}
+		case zapcore.StringerType:
+			if stringer, ok := field.Interface.(fmt.Stringer); ok {
+				field = zap.String(field.Key, redactTokens(stringer.String()))
+			}
+		}
+		redactedFields[index] = field
+	}
+	return redactedFields
+}
+
+// requestLog is the logger of one request. It carries the request id and, once the token is
+// verified, the subject and issuer of the caller.
+type requestLog struct {
+	mutex     sync.Mutex
+	logger    *zap.SugaredLogger
+	requestId string
+	subject   string
+	issuer    string
+}
+
+type requestLogKey struct{}
+
+func withRequestLog(ctx context.Context, logger *zap.SugaredLogger, requestId string) (context.Context, *requestLog) {
+	log := &requestLog{logger: logger, requestId: requestId}
+	return context.WithValue(ctx, requestLogKey{}, log), log
+}
+
+func (l *requestLog) current() *zap.SugaredLogger {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.logger
+}
+
+// requestLogger returns the logger of the request, or the global logger outside of requests
+func requestLogger(ctx context.Context) *zap.SugaredLogger {
+	log, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return Logger
+	}
+	return log.current()
+}
+
+// setRequestIdentity adds the caller of a verified token to the request logger
+func setRequestIdentity(ctx context.Context, subject string, issuer string) {
+	log, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.logger = log.logger.With("subject", subject, "issuer", issuer)
+	log.subject = subject
+	log.issuer = issuer
+}
+
+// requestActor returns the request id and the verified caller of the request, empty outside of requests
+func requestActor(ctx context.Context) (string, string, string) {
+	log, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return "", "", ""
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.requestId, log.subject, log.issuer
+}
@@ -1,22 +1,139 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.yaml.in/yaml/v3"
 )
 
 func main() {
 	// Init Logger
 	InitializeLogger()
 
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML or JSON config file, environment variables override it")
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		if flag.Arg(0) != "config" {
+			fmt.Fprintln(os.Stderr, "Unknown command "+flag.Arg(0)+", usage: [--config file] [config validate|config print [--redacted]]")
+			os.Exit(2)
+		}
+		os.Exit(configCommand(*configPath, flag.Args()[1:]))
+	}
+
+	os.Exit(run(*configPath))
+}
+
+// run starts the service and returns the exit code once it has shut down
+func run(configPath string) int {
 	// Get config
-	config, err := getConfig()
+	config, err := loadConfig(configPath)
+	if err != nil {
+		Logger.Error(err)
+		return 1
+	}
+	configureLogger(config)
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		Logger.Error(err)
+		return 1
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownTracing(ctx)
+	}()
+
+	err = initDBPool(config)
+	if err != nil {
+		Logger.Error(err)
+		return 1
+	}
+	defer closeDBPool()
+
+	err = autoMigrate(config)
+	if err != nil {
+		Logger.Error(err)
+		return 1
+	}
+
+	// Load keys for issued claim tokens
+	err = initSigningKeys(config)
+	if err != nil {
+		Logger.Error(err)
+		return 1
+	}
+
+	// Policy service client with timeouts, retries and circuit breakers
+	err = initTSAClient(config)
+	if err != nil {
+		Logger.Error(err)
+		return 1
+	}
+	defer tsaClient().close()
+
+	// Cache resolved mappings
+	initResolutionCache(config)
+
+	// Archive expired mappings in the background
+	go startMappingSweeper(config)
+
+	// Reload the config file on change and on SIGHUP
+	server := newServer(config)
+	go watchConfig(server, configPath, config.configWatchInterval)
+
+	// Start Rest API server, SIGTERM and SIGINT shut it down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	err = runServer(ctx, server)
 	if err != nil {
 		Logger.Error(err)
-		os.Exit(0)
+		return 1
 	}
+	Logger.Info("Shut down")
+	return 0
+}
 
-	autoMigrate(config)
+// configCommand runs "config validate" and "config print [--redacted]" and returns the exit code
+func configCommand(configPath string, args []string) int {
+	if len(args) == 0 || (args[0] != "validate" && args[0] != "print") {
+		fmt.Fprintln(os.Stderr, "Usage: config validate|print [--redacted] [--config file]")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("config "+args[0], flag.ContinueOnError)
+	flags.StringVar(&configPath, "config", configPath, "YAML or JSON config file, environment variables override it")
+	redacted := flags.Bool("redacted", false, "mask secrets")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return 2
+	}
 
-	// Start Rest API server
-    startServer(&config.port)
-}
\ No newline at end of file
+	config, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Configuration is invalid:")
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if args[0] == "validate" {
+		fmt.Println("Configuration is valid")
+		return 0
+	}
+
+	output, err := yaml.Marshal(config.printable(*redacted))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(string(output))
+	return 0
+}
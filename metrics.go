@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Prometheus metrics served on /metrics. Requests are labelled by route template instead of the
+// URI so that ids in query strings or paths do not create new series.
+const metricsNamespace = "claim_mapping"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method, route template and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	claimResolutions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "claim_resolutions_total",
+		Help:      "Claim resolutions of a context by outcome: no_policy, evaluated, failed_open, failed_closed or error.",
+	}, []string{"outcome"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Database query latency by SQL command and result.",
+		Buckets:   []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+	}, []string{"command", "result"})
+
+	jwksFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "jwks_fetches_total",
+		Help:      "Fetches of the identity provider JWKS by result.",
+	}, []string{"result"})
+
+	jwksFetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "jwks_fetch_duration_seconds",
+		Help:      "Latency of fetching the discovery document and JWKS of the identity provider.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	policyRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "policy_request_duration_seconds",
+		Help:      "Latency of single policy service requests by host and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"host", "result"})
+
+	policyRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "policy_request_errors_total",
+		Help:      "Failed policy service calls by host and reason: status code, circuit_open, timeout or connection.",
+	}, []string{"host", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(metricsCollector{})
+}
+
+// metricsCollector reads the state that is kept elsewhere at scrape time: pool statistics,
+// circuit breaker states and resolution cache counters
+type metricsCollector struct{}
+
+var (
+	dbPoolConnsDesc = prometheus.NewDesc(metricsNamespace+"_db_pool_connections",
+		"Database pool connections by state.", []string{"state"}, nil)
+	dbPoolMaxConnsDesc = prometheus.NewDesc(metricsNamespace+"_db_pool_max_connections",
+		"Maximum size of the database pool.", nil, nil)
+	dbPoolAcquiresDesc = prometheus.NewDesc(metricsNamespace+"_db_pool_acquires_total",
+		"Connections acquired from the database pool.", nil, nil)
+	dbPoolAcquireWaitDesc = prometheus.NewDesc(metricsNamespace+"_db_pool_acquire_wait_seconds_total",
+		"Time spent waiting for a database connection.", nil, nil)
+	policyCircuitDesc = prometheus.NewDesc(metricsNamespace+"_policy_circuit_state",
+		"Circuit breaker state per policy service host, 1 for the current state.", []string{"host", "state"}, nil)
+	cacheSizeDesc = prometheus.NewDesc(metricsNamespace+"_resolution_cache_entries",
+		"Entries in the resolution cache.", nil, nil)
+	cacheHitsDesc = prometheus.NewDesc(metricsNamespace+"_resolution_cache_hits_total",
+		"Resolution cache hits.", nil, nil)
+	cacheMissesDesc = prometheus.NewDesc(metricsNamespace+"_resolution_cache_misses_total",
+		"Resolution cache misses.", nil, nil)
+	cacheEvictionsDesc = prometheus.NewDesc(metricsNamespace+"_resolution_cache_evictions_total",
+		"Resolution cache entries evicted by size.", nil, nil)
+	cacheInvalidationsDesc = prometheus.NewDesc(metricsNamespace+"_resolution_cache_invalidations_total",
+		"Resolution cache invalidations.", nil, nil)
+)
+
+func (c metricsCollector) Describe(descs chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{dbPoolConnsDesc, dbPoolMaxConnsDesc, dbPoolAcquiresDesc, dbPoolAcquireWaitDesc,
+		policyCircuitDesc, cacheSizeDesc, cacheHitsDesc, cacheMissesDesc, cacheEvictionsDesc, cacheInvalidationsDesc} {
+		descs <- desc
+	}
+}
+
+func (c metricsCollector) Collect(metrics chan<- prometheus.Metric) {
+	if dbPool != nil {
+		stat := dbPool.Stat()
+		metrics <- prometheus.MustNewConstMetric(dbPoolConnsDesc, prometheus.GaugeValue, float64(stat.AcquiredConns()), "acquired")
+		metrics <- prometheus.MustNewConstMetric(dbPoolConnsDesc, prometheus.GaugeValue, float64(stat.IdleConns()), "idle")
+		metrics <- prometheus.MustNewConstMetric(dbPoolConnsDesc, prometheus.GaugeValue, float64(stat.ConstructingConns()), "constructing")
+		metrics <- prometheus.MustNewConstMetric(dbPoolMaxConnsDesc, prometheus.GaugeValue, float64(stat.MaxConns()))
+		metrics <- prometheus.MustNewConstMetric(dbPoolAcquiresDesc, prometheus.CounterValue, float64(stat.AcquireCount()))
+		metrics <- prometheus.MustNewConstMetric(dbPoolAcquireWaitDesc, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+	}
+
+	for host, state := range tsaClient().circuitStates() {
+		for _, circuitState := range []string{circuitClosed, circuitOpen, circuitHalfOpen} {
+			value := 0.0
+			if state == circuitState {
+				value = 1
+			}
+			metrics <- prometheus.MustNewConstMetric(policyCircuitDesc, prometheus.GaugeValue, value, host, circuitState)
+		}
+	}
+
+	stats := resolutionCache.stats()
+	metrics <- prometheus.MustNewConstMetric(cacheSizeDesc, prometheus.GaugeValue, float64(stats.Size))
+	metrics <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	metrics <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Misses))
+	metrics <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+	metrics <- prometheus.MustNewConstMetric(cacheInvalidationsDesc, prometheus.CounterValue, float64(stats.Invalidations))
+}
+
+// statusRecorder remembers the status code and body size written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(body []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	size, err := r.ResponseWriter.Write(body)
+	r.size += size
+	return size, err
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to extend the write deadline
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// instrumentRequests counts the requests served by the router and observes their latency
+func instrumentRequests(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		router.ServeHTTP(recorder, r)
+
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			template, err := match.Route.GetPathTemplate()
+			if err == nil {
+				route = template
+			}
+		}
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(attribute.String("http.route", route))
+
+		status := strconv.Itoa(recorder.statusCode())
+		httpRequests.WithLabelValues(r.Method, route, status).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, route, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// dbQueryTracer observes the latency of every query run on the pool and records a span for it
+type dbQueryTracer struct{}
+
+type dbQueryStartKey struct{}
+
+type dbQueryStart struct {
+	start   time.Time
+	command string
+	span    trace.Span
+}
+
+func (t dbQueryTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	command := sqlCommand(data.SQL)
+	ctx, span := tracer.Start(ctx, "db."+command, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.statement", data.SQL),
+	))
+	return context.WithValue(ctx, dbQueryStartKey{}, dbQueryStart{start: time.Now(), command: command, span: span})
+}
+
+func (t dbQueryTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	queryStart, ok := ctx.Value(dbQueryStartKey{}).(dbQueryStart)
+	if !ok {
+		return
+	}
+	result := "ok"
+	if data.Err != nil {
+		result = "error"
+	}
+	dbQueryDuration.WithLabelValues(queryStart.command, result).Observe(time.Since(queryStart.start).Seconds())
+	endSpan(queryStart.span, data.Err)
+}
+
+// sqlCommand returns the SQL command of a statement in lower case, e.g. "select"
+func sqlCommand(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	command := strings.ToLower(fields[0])
+	switch command {
+	case "select", "insert", "update", "delete", "with", "begin", "commit", "rollback", "listen":
+		return command
+	}
+	return "other"
+}
+
+// policyErrorReason classifies a failed policy call for policy_request_errors_total
+func policyErrorReason(ctx context.Context, err error) string {
+	var statusError *policyStatusError
+	switch {
+	case err == errCircuitOpen:
+		return "circuit_open"
+	case errors.As(err, &statusError):
+		return strconv.Itoa(statusError.StatusCode)
+	case ctx.Err() != nil:
+		return "timeout"
+	}
+	return "connection"
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// policyTLSConfig returns the TLS configuration for mTLS to the policy services, nil without
+// a client certificate or CA
+func policyTLSConfig(config config) (*tls.Config, error) {
+	if len(config.tsaClientCertFile) == 0 && len(config.tsaCAFile) == 0 {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(config.tsaClientCertFile) > 0 {
+		certificate, err := tls.LoadX509KeyPair(config.tsaClientCertFile, config.tsaClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid policy client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if len(config.tsaCAFile) > 0 {
+		caBytes, err := os.ReadFile(config.tsaCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid policy CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("Invalid policy CA file: no certificates found")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// clientCredentials fetches and caches an access token for the policy services with the
+// OAuth 2.0 client credentials grant
+type clientCredentials struct {
+	mutex        sync.Mutex
+	tokenURL     string
+	clientId     string
+	clientSecret string
+	scope        string
+
+	accessToken string
+	expires     time.Time
+}
+
+// tokenRefreshMargin renews access tokens shortly before they expire
+const tokenRefreshMargin = 30 * time.Second
+
+func newClientCredentials(config config) *clientCredentials {
+	if len(config.tsaClientId) == 0 {
+		return nil
+	}
+	return &clientCredentials{
+		tokenURL:     config.tsaTokenURL,
+		clientId:     config.tsaClientId,
+		clientSecret: config.tsaClientSecret,
+		scope:        config.tsaScope,
+	}
+}
+
+func (c *clientCredentials) token(ctx context.Context, httpClient *http.Client) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.accessToken) > 0 && time.Now().Before(c.expires) {
+		return c.accessToken, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(c.scope) > 0 {
+		form.Set("scope", c.scope)
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(c.clientId), url.QueryEscape(c.clientSecret))
+
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	responseBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("policy service token request failed with status code (%v)", resp.StatusCode)
+	}
+
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = json.Unmarshal(responseBody, &tokenResponse)
+	if err != nil || len(tokenResponse.AccessToken) == 0 {
+		return "", fmt.Errorf("policy service token response is invalid")
+	}
+
+	c.accessToken = tokenResponse.AccessToken
+	c.expires = time.Now().Add(time.Duration(tokenResponse.ExpiresIn)*time.Second - tokenRefreshMargin)
+	return c.accessToken, nil
+}
+
+// invalidate drops the cached token after the policy service rejected it
+func (c *clientCredentials) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.accessToken = ""
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/open-policy-agent/opa/v1/rego"
+)
+
+const (
+	policyEvaluatorTSA  = "tsa"
+	policyEvaluatorOPA  = "opa"
+	policyEvaluatorRego = "rego"
+)
+
+// The requestor sent to a policy is, depending on the requestor mode, the user's raw access token,
+// only selected attributes of it, or a short-lived assertion about the user signed by this service.
+const (
+	requestorModeToken      = "token"
+	requestorModeAttributes = "attributes"
+	requestorModeAssertion  = "assertion"
+)
+
+const requestorAssertionLifetime = time.Minute
+
+// policyAssertionAudience is always an audience of requestor assertions, besides the policy URL
+const policyAssertionAudience = "urn:claim-mapping-service:policy-assertion"
+
+func isValidRequestorMode(mode string) bool {
+	return mode == requestorModeToken || mode == requestorModeAttributes || mode == requestorModeAssertion
+}
+
+// policyRequestor builds the requestor of a policy request from the token and its roles
+func policyRequestor(config config, policy contextPolicy, contextId string, rawToken string, attributes map[string]interface{}, rolesArray []string) (interface{}, error) {
+	var subject interface{}
+	if token, ok := attributes["token"].(map[string]interface{}); ok {
+		subject = token["sub"]
+	}
+	if rolesArray == nil {
+		rolesArray = []string{}
+	}
+
+	switch policy.RequestorMode {
+	case requestorModeAttributes:
+		return map[string]interface{}{
+			"sub":     subject,
+			"roles":   rolesArray,
+			"context": contextId,
+		}, nil
+	case requestorModeAssertion:
+		now := time.Now()
+		assertionClaims := jwt.MapClaims{
+			"iat":     now.Unix(),
+			"exp":     now.Add(requestorAssertionLifetime).Unix(),
+			"jti":     uuid.New().String(),
+			"roles":   rolesArray,
+			"context": contextId,
+		}
+		if issuer := tokenIssuer(config); len(issuer) > 0 {
+			assertionClaims["iss"] = issuer
+		}
+		if subject != nil {
+			assertionClaims["sub"] = subject
+		}
+		audience := []string{policyAssertionAudience}
+		if len(policy.URL) > 0 {
+			audience = append(audience, policy.URL)
+		}
+		assertionClaims["aud"] = audience
+		return signingKeys.sign(assertionClaims, policyAssertionType)
+	}
+	return rawToken, nil
+}
+
+// PolicyEvaluator filters the claims resolved for a context by policy
+type PolicyEvaluator interface {
+	Evaluate(ctx context.Context, request policyRequest) (policyResult, error)
+}
+
+// policyRequest is the input of every policy: the context, the claims to filter and the requestor
+type policyRequest struct {
+	Context   string      `json:"context"`
+	Claims    []string    `json:"claims"`
+	Requestor interface{} `json:"requestor"`
+}
+
+// policyResult is the decision of a policy
+type policyResult struct {
+	Claims        []string          `json:"claims"`
+	Reasons       map[string]string `json:"reasons,omitempty"`
+	PolicyVersion string            `json:"policy_version,omitempty"`
+}
+
+func isValidPolicyEvaluator(evaluator string) bool {
+	return evaluator == policyEvaluatorTSA || evaluator == policyEvaluatorOPA || evaluator == policyEvaluatorRego
+}
+
+// tsaEvaluator posts the request to a TSA policy URL
+type tsaEvaluator struct {
+	url string
+}
+
+func (e tsaEvaluator) Evaluate(ctx context.Context, request policyRequest) (policyResult, error) {
+	return tsaGetContextClaimsRequest(ctx, e.url, request)
+}
+
+// opaEvaluator queries a decision of Open Policy Agent's Data API, e.g. http://opa:8181/v1/data/claims/allowed.
+// The decision has the same shape as a TSA response.
+type opaEvaluator struct {
+	url string
+}
+
+func (e opaEvaluator) Evaluate(ctx context.Context, request policyRequest) (policyResult, error) {
+	jsonBody, _ := json.Marshal(map[string]interface{}{"input": request})
+
+	responseBody, err := tsaClient().post(ctx, e.url, jsonBody)
+	if err != nil {
+		return policyResult{}, err
+	}
+
+	var response struct {
+		Result json.RawMessage `json:"result"`
+	}
+	err = json.Unmarshal(responseBody, &response)
+	if err != nil {
+		return policyResult{}, fmt.Errorf("invalid policy response: %v", err)
+	}
+	if len(response.Result) == 0 {
+		return policyResult{}, fmt.Errorf("invalid policy response: decision is undefined")
+	}
+	return parsePolicyResult(response.Result)
+}
+
+// regoEvaluator evaluates a query against a Rego bundle loaded from REGO_BUNDLES_DIR.
+// Prepared queries are kept per bundle and query together with a fingerprint of the bundle files.
+// The fingerprint is checked at most every regoBundleCheckInterval, so a bundle changed on disk is
+// read again shortly after, and a SIGHUP reloads every bundle right away.
+type regoEvaluator struct {
+	bundlesDir string
+	bundle     string
+	query      string
+}
+
+const regoBundleCheckInterval = 30 * time.Second
+
+type regoPreparedQuery struct {
+	fingerprint string
+	checkedAt   time.Time
+	query       rego.PreparedEvalQuery
+}
+
+var regoQueries sync.Map
+
+func clearRegoQueries() {
+	regoQueries.Range(func(key, value interface{}) bool {
+		regoQueries.Delete(key)
+		return true
+	})
+}
+
+// bundleFingerprint hashes the names, sizes and modification times of the bundle files, the bundle
+// is either a directory or an archive
+func bundleFingerprint(bundlePath string) (string, error) {
+	hash := sha256.New()
+	err := filepath.WalkDir(bundlePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\x00", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (e regoEvaluator) prepare(ctx context.Context) (rego.PreparedEvalQuery, error) {
+	bundlePath := filepath.Join(e.bundlesDir, e.bundle)
+	key := bundlePath + "\x00" + e.query
+	cached, found := regoQueries.Load(key)
+	if found && time.Since(cached.(regoPreparedQuery).checkedAt) < regoBundleCheckInterval {
+		return cached.(regoPreparedQuery).query, nil
+	}
+
+	now := time.Now()
+	fingerprint, err := bundleFingerprint(bundlePath)
+	if err != nil {
+		return rego.PreparedEvalQuery{}, fmt.Errorf("Invalid policy bundle %s: %v", e.bundle, err)
+	}
+	if found && cached.(regoPreparedQuery).fingerprint == fingerprint {
+		prepared := cached.(regoPreparedQuery)
+		prepared.checkedAt = now
+		regoQueries.Store(key, prepared)
+		return prepared.query, nil
+	}
+
+	query, err := rego.New(rego.Query(e.query), rego.LoadBundle(bundlePath)).PrepareForEval(ctx)
+	if err != nil {
+		return rego.PreparedEvalQuery{}, fmt.Errorf("Invalid policy bundle %s: %v", e.bundle, err)
+	}
+	regoQueries.Store(key, regoPreparedQuery{fingerprint: fingerprint, checkedAt: now, query: query})
+	return query, nil
+}
+
+func (e regoEvaluator) Evaluate(ctx context.Context, request policyRequest) (policyResult, error) {
+	query, err := e.prepare(ctx)
+	if err != nil {
+		return policyResult{}, err
+	}
+
+	// The input is passed as generic JSON data, the same document TSA and OPA receive
+	var input interface{}
+	jsonInput, _ := json.Marshal(request)
+	json.Unmarshal(jsonInput, &input)
+
+	results, err := query.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return policyResult{}, err
+	}
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return policyResult{}, fmt.Errorf("invalid policy response: decision is undefined")
+	}
+
+	decision, err := json.Marshal(results[0].Expressions[0].Value)
+	if err != nil {
+		return policyResult{}, err
+	}
+	return parsePolicyResult(decision)
+}
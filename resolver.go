@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	claimSourceMapping = "mapping"
+	claimSourceDefault = "default"
+)
+
+const (
+	claimOutcomeGranted          = "granted"
+	claimOutcomeShadowed         = "shadowed"
+	claimOutcomeNotValid         = "not_valid"
+	claimOutcomeConditionNotMet  = "condition_not_met"
+	claimOutcomeConditionError   = "condition_error"
+	claimOutcomeRejectedByPolicy = "rejected_by_policy"
+	claimOutcomeDenied           = "denied"
+)
+
+const (
+	policyDecisionAllowed       = "allowed"
+	policyDecisionRejected      = "rejected"
+	policyDecisionNotConfigured = "not_configured"
+	policyDecisionFailedOpen    = "failed_open"
+	policyDecisionFailedClosed  = "failed_closed"
+)
+
+// claimDecision explains how a single candidate claim was handled during resolution
+type claimDecision struct {
+	Claim               string     `json:"claim"`
+	Source              string     `json:"source"`
+	Effect              string     `json:"effect,omitempty"`
+	MappingId           *uuid.UUID `json:"mapping_id,omitempty"`
+	MappingName         string     `json:"mapping_name,omitempty"`
+	MappingContext      string     `json:"mapping_context,omitempty"`
+	Condition           string     `json:"condition,omitempty"`
+	DefaultClaimId      *int64     `json:"default_claim_id,omitempty"`
+	DefaultClaimContext string     `json:"default_claim_context,omitempty"`
+	Role                string     `json:"role,omitempty"`
+	PolicyDecision      string     `json:"policy_decision,omitempty"`
+	Outcome             string     `json:"outcome"`
+	Reason              string     `json:"reason,omitempty"`
+}
+
+// contextExplanation is the response of the explain endpoints
+type contextExplanation struct {
+	Context         string          `json:"context"`
+	Roles           []string        `json:"roles"`
+	PolicyURL       bool            `json:"policy_configured"`
+	PolicyEvaluator string          `json:"policy_evaluator,omitempty"`
+	PolicyVersion   string          `json:"policy_version,omitempty"`
+	Claims          []claimResponse `json:"claims"`
+	Denied          []claimDenial   `json:"denied,omitempty"`
+	Decisions       []claimDecision `json:"decisions"`
+}
+
+// resolveMappingCandidates picks, per claim and effect, the most specific mapping valid at request time
+// whose condition holds. Default claim rules among the candidates are left to resolveDefaultCandidates.
+// A condition that fails to evaluate never grants a claim but always applies a deny.
+func resolveMappingCandidates(ctx context.Context, candidates []mappingCandidate, attributes map[string]interface{}, requestTime time.Time) ([]contextClaim, []claimDenial, []claimDecision) {
+	claims := []contextClaim{}
+	var denials []claimDenial
+	var decisions []claimDecision
+	resolved := make(map[string]bool)
+
+	for _, candidate := range candidates {
+		if candidate.Source != claimSourceMapping {
+			continue
+		}
+
+		mappingId := candidate.MappingId
+		decision := claimDecision{
+			Claim:          candidate.Claim.Claim,
+			Source:         claimSourceMapping,
+			Effect:         candidate.Effect,
+			MappingId:      &mappingId,
+			MappingName:    candidate.MappingName,
+			MappingContext: candidate.MappingContext,
+			Condition:      candidate.Condition,
+			Role:           candidate.Role,
+		}
+
+		if (candidate.ValidFrom != nil && requestTime.Before(*candidate.ValidFrom)) || (candidate.ValidUntil != nil && !requestTime.Before(*candidate.ValidUntil)) {
+			decision.Outcome = claimOutcomeNotValid
+			decision.Reason = "mapping is outside of its validity window"
+			decisions = append(decisions, decision)
+			continue
+		}
+
+		key := candidate.Effect + ":" + candidate.Claim.Claim
+		if resolved[key] {
+			decision.Outcome = claimOutcomeShadowed
+			decision.Reason = "a more specific mapping matched"
+			decisions = append(decisions, decision)
+			continue
+		}
+
+		matched, err := evaluateCondition(ctx, candidate.Condition, attributes)
+		if err != nil {
+			requestLogger(ctx).Warn("Condition of mapping " + candidate.MappingId.String() + " failed. " + err.Error())
+			matched = candidate.Effect == mappingEffectDeny
+			decision.Outcome = claimOutcomeConditionError
+			decision.Reason = err.Error()
+		}
+		if !matched {
+			if len(decision.Outcome) == 0 {
+				decision.Outcome = claimOutcomeConditionNotMet
+			}
+			decisions = append(decisions, decision)
+			continue
+		}
+		resolved[key] = true
+
+		if candidate.Effect == mappingEffectDeny {
+			denials = append(denials, claimDenial{
+				Claim:          candidate.Claim.Claim,
+				MappingId:      candidate.MappingId,
+				MappingName:    candidate.MappingName,
+				MappingContext: candidate.MappingContext,
+			})
+			decision.Outcome = claimOutcomeDenied
+			decision.Reason = "deny mapping applies"
+		} else {
+			claims = append(claims, candidate.Claim)
+			decision.Outcome = claimOutcomeGranted
+		}
+		decisions = append(decisions, decision)
+	}
+
+	return claims, denials, decisions
+}
+
+// resolveContext runs the claim resolution for one context and counts it in claim_resolutions_total
+func resolveContext(ctx context.Context, config config, contextId string, rolesArray []string, attributes map[string]interface{}, rawToken string, requestTime time.Time) (*contextClaims, []claimDecision, error) {
+	result, decisions, _, outcome, err := runContextResolution(ctx, config, contextId, rolesArray, attributes, rawToken, requestTime)
+	claimResolutions.WithLabelValues(outcome).Inc()
+	return result, decisions, err
+}
+
+// runContextResolution resolves the claims of one context: mappings and their conditions,
+// TSA policy filtering, default claims and finally deny mappings. It also returns the policy of the
+// context and the outcome.
+func runContextResolution(ctx context.Context, config config, contextId string, rolesArray []string, attributes map[string]interface{}, rawToken string, requestTime time.Time) (*contextClaims, []claimDecision, contextPolicy, string, error) {
+	outcome := "error"
+
+	// Get DB claims
+	candidates, err := listContextRolesClaims(ctx, config, contextId, rolesArray)
+	if err != nil {
+		return nil, nil, contextPolicy{}, outcome, err
+	}
+	claims, denials, decisions := resolveMappingCandidates(ctx, candidates, attributes, requestTime)
+	result := &contextClaims{Context: contextId, Claims: claims}
+
+	policy, err := getContextPolicy(ctx, config, contextId)
+	if err != nil {
+		return nil, nil, contextPolicy{}, outcome, err
+	}
+	policyDecision := policyDecisionNotConfigured
+	failedClosed := false
+	var policyReasons map[string]string
+	if policy.configured() {
+		var claimsString []string
+		for _, claim := range claims {
+			claimsString = append(claimsString, claim.Claim)
+		}
+		requestor, err := policyRequestor(config, policy, contextId, rawToken, attributes, rolesArray)
+		if err != nil {
+			return nil, nil, contextPolicy{}, outcome, err
+		}
+		tsaClaims, err := policy.evaluate(ctx, config, policyRequest{Context: contextId, Claims: claimsString, Requestor: requestor})
+		if err != nil && ctx.Err() != nil {
+			return nil, nil, contextPolicy{}, outcome, err
+		}
+
+		if err != nil && policy.FailMode == contextFailModeOpen {
+			// Fail open, the mapped claims are returned unfiltered
+			requestLogger(ctx).Warn("Policy evaluation for context " + contextId + " failed, returning unfiltered claims. " + err.Error())
+			policyDecision = policyDecisionFailedOpen
+		} else if err != nil {
+			// Fail closed, the context grants no claims at all
+			requestLogger(ctx).Warn("Policy evaluation for context " + contextId + " failed, returning no claims. " + err.Error())
+			policyDecision = policyDecisionFailedClosed
+			failedClosed = true
+			result.Claims = []contextClaim{}
+		} else {
+			finalClaims := []contextClaim{}
+			for _, claim := range claims {
+				if containsString(tsaClaims.Claims, claim.Claim) {
+					finalClaims = append(finalClaims, claim)
+				}
+			}
+			result.Claims = finalClaims
+			result.PolicyVersion = tsaClaims.PolicyVersion
+			policyReasons = tsaClaims.Reasons
+			policyDecision = policyDecisionRejected
+		}
+	}
+
+	for index := range decisions {
+		if decisions[index].Effect != mappingEffectAllow || decisions[index].Outcome != claimOutcomeGranted {
+			continue
+		}
+		decisions[index].PolicyDecision = policyDecision
+		if policyDecision == policyDecisionRejected || policyDecision == policyDecisionFailedClosed {
+			decisions[index].Outcome = claimOutcomeRejectedByPolicy
+			if failedClosed {
+				decisions[index].Reason = "policy evaluation failed"
+			} else if reason, found := policyReasons[decisions[index].Claim]; found {
+				decisions[index].Reason = reason
+			}
+			for _, claim := range result.Claims {
+				if claim.Claim == decisions[index].Claim {
+					decisions[index].PolicyDecision = policyDecisionAllowed
+					decisions[index].Outcome = claimOutcomeGranted
+				}
+			}
+		}
+	}
+
+	outcome = resolutionOutcome(policyDecision)
+	if failedClosed {
+		return result, decisions, policy, outcome, nil
+	}
+
+	decisions = append(decisions, resolveDefaultCandidates(candidates, result)...)
+	applyDenials(result, denials)
+
+	for index := range decisions {
+		if decisions[index].Outcome != claimOutcomeGranted || decisions[index].Effect == mappingEffectDeny {
+			continue
+		}
+		for _, denial := range result.Denied {
+			if denial.Claim == decisions[index].Claim {
+				decisions[index].Outcome = claimOutcomeDenied
+				decisions[index].Reason = "denied by mapping " + denial.MappingId.String() + " (" + denial.MappingName + ")"
+			}
+		}
+	}
+
+	return result, decisions, policy, outcome, nil
+}
+
+// resolutionOutcome names the outcome of a context resolution for claim_resolutions_total
+func resolutionOutcome(policyDecision string) string {
+	switch policyDecision {
+	case policyDecisionNotConfigured:
+		return "no_policy"
+	case policyDecisionRejected:
+		return "evaluated"
+	}
+	return policyDecision
+}
+
+func explainContext(ctx context.Context, config config, contextId string, rolesArray []string, attributes map[string]interface{}, rawToken string, requestTime time.Time) (contextExplanation, error) {
+	// Explanations are not counted as resolutions
+	result, decisions, policy, _, err := runContextResolution(ctx, config, contextId, rolesArray, attributes, rawToken, requestTime)
+	if err != nil {
+		return contextExplanation{}, err
+	}
+
+	response := result.response()
+	if decisions == nil {
+		decisions = []claimDecision{}
+	}
+	if rolesArray == nil {
+		rolesArray = []string{}
+	}
+	return contextExplanation{
+		Context:         contextId,
+		Roles:           rolesArray,
+		PolicyURL:       policy.configured(),
+		PolicyEvaluator: policy.Evaluator,
+		PolicyVersion:   result.PolicyVersion,
+		Claims:          response.Claims,
+		Denied:          response.Denied,
+		Decisions:       decisions,
+	}, nil
+}
+
+// resolveContexts resolves several contexts concurrently, at most config.policyConcurrency at a time.
+// Each context is evaluated by its policy in a single request.
+func resolveContexts(ctx context.Context, config config, contextIds []string, rolesArray []string, tokenData interface{}, r *http.Request, rawToken string, requestTime time.Time) ([]*contextClaims, error) {
+	results := make([]*contextClaims, len(contextIds))
+	errs := make([]error, len(contextIds))
+
+	concurrency := config.policyConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	workers := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for index, contextId := range contextIds {
+		wg.Add(1)
+		go func(index int, contextId string) {
+			defer wg.Done()
+			select {
+			case workers <- struct{}{}:
+				defer func() { <-workers }()
+			case <-ctx.Done():
+				errs[index] = ctx.Err()
+				return
+			}
+
+			attributes := conditionAttributes(tokenData, r, contextId, requestTime)
+			results[index], _, errs[index] = resolveContext(ctx, config, contextId, rolesArray, attributes, rawToken, requestTime)
+		}(index, contextId)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
@@ -1,77 +1,224 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	"github.com/yalp/jsonpath"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+const requestIdHeader = "X-Request-ID"
+
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestLogger assigns a request id, or keeps a well-formed one of the caller, and logs every request
+// with status, response size and duration. Handlers log through requestLogger(r.Context()), so their
+// messages carry the request id, the trace id and, once the token is verified, subject and issuer.
 func RequestLogger(targetMux http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
-		targetMux.ServeHTTP(w, r)
+		requestId := r.Header.Get(requestIdHeader)
+		if !requestIdPattern.MatchString(requestId) {
+			requestId = uuid.New().String()
+		}
+		w.Header().Set(requestIdHeader, requestId)
+
+		logger := Logger.With("request_id", requestId)
+		spanContext := trace.SpanContextFromContext(r.Context())
+		if spanContext.IsValid() {
+			logger = logger.With("trace_id", spanContext.TraceID().String())
+		}
+		ctx, log := withRequestLog(r.Context(), logger, requestId)
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		targetMux.ServeHTTP(recorder, r.WithContext(ctx))
 
-		if string(r.RequestURI) != "/isAlive" {
-			Logger.Infow("",
-				zap.String("method", string(r.Method)),
-				zap.String("uri", string(r.RequestURI)),
-				zap.Duration("duration", time.Since(start)*1000),
-			)
+		if isProbe(r.RequestURI) {
+			return
+		}
+		status := recorder.statusCode()
+		fields := []interface{}{
+			zap.String("method", r.Method),
+			zap.String("uri", redactedURI(r)),
+			zap.Int("status", status),
+			zap.Int("size", recorder.size),
+			zap.Duration("duration", time.Since(start)),
+		}
+		switch {
+		case status >= 500:
+			log.current().Errorw("Request failed", fields...)
+		case status >= 400:
+			log.current().Warnw("Request rejected", fields...)
+		default:
+			log.current().Infow("Request served", fields...)
 		}
 	})
 }
 
-func startServer(port *int) {
+// redactedURI returns the path with the values of all query parameters masked, they may contain
+// context ids or tokens
+func redactedURI(r *http.Request) string {
+	query := r.URL.Query()
+	if len(query) == 0 {
+		return r.URL.Path
+	}
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parameters []string
+	for _, name := range names {
+		parameters = append(parameters, url.QueryEscape(name)+"="+redacted)
+	}
+	return r.URL.Path + "?" + strings.Join(parameters, "&")
+}
+
+// isProbe reports whether the request is a health probe or metrics scrape, those are not logged
+func isProbe(uri string) bool {
+	return uri == "/isAlive" || uri == "/livez" || uri == "/readyz" || uri == "/metrics"
+}
+
+// server serves the REST API. Its configuration is swapped atomically when the config file is reloaded,
+// every request works with the configuration current at its start.
+type server struct {
+	config atomic.Pointer[config]
+}
+
+func newServer(config config) *server {
+	s := &server{}
+	s.config.Store(&config)
+	return s
+}
+
+func (s *server) currentConfig() config {
+	return *s.config.Load()
+}
+
+// runServer serves the REST API until ctx is done, then stops accepting connections and waits up to
+// SHUTDOWN_TIMEOUT for the running requests
+func runServer(ctx context.Context, s *server) error {
 	router := mux.NewRouter().StrictSlash(true)
 
-	router.HandleFunc("/claims", claimsGet).Methods("GET")
+	router.HandleFunc("/claims", s.claimsGet).Methods("GET")
+	router.HandleFunc("/claims/explain", s.claimsExplainGet).Methods("GET")
+	if s.currentConfig().tokenExchangeEnabled {
+		router.HandleFunc("/token", s.tokenExchangePost).Methods("POST")
+	}
+	router.HandleFunc("/mapper/claims", s.mapperClaimsPost).Methods("POST")
+	router.HandleFunc("/.well-known/jwks.json", jwksGet).Methods("GET")
+	router.HandleFunc("/.well-known/openid-configuration", s.openidConfigurationGet).Methods("GET")
 
-	router.HandleFunc("/list/roles", listRolesGet).Methods("GET")
-	router.HandleFunc("/list/roles", listRolesPost).Methods("POST")
-	router.HandleFunc("/list/roles", listRolesPut).Methods("PUT")
-	router.HandleFunc("/list/roles", listRolesDelete).Methods("DELETE")
+	router.HandleFunc("/list/roles", s.listRolesGet).Methods("GET")
+	router.HandleFunc("/list/roles", s.listRolesPost).Methods("POST")
+	router.HandleFunc("/list/roles", s.listRolesPut).Methods("PUT")
+	router.HandleFunc("/list/roles", s.listRolesDelete).Methods("DELETE")
 
-	router.HandleFunc("/list/claims", listClaimsGet).Methods("GET")
-	router.HandleFunc("/list/claims", listClaimsPost).Methods("POST")
-	router.HandleFunc("/list/claims", listClaimsPut).Methods("PUT")
-	router.HandleFunc("/list/claims", listClaimsDelete).Methods("DELETE")
+	router.HandleFunc("/list/claims", s.listClaimsGet).Methods("GET")
+	router.HandleFunc("/list/claims", s.listClaimsPost).Methods("POST")
+	router.HandleFunc("/list/claims", s.listClaimsPut).Methods("PUT")
+	router.HandleFunc("/list/claims", s.listClaimsDelete).Methods("DELETE")
 
-	router.HandleFunc("/list/mappings", listMappingsGet).Methods("GET")
-	router.HandleFunc("/list/mappings", listMappingsPost).Methods("POST")
-	router.HandleFunc("/list/mappings", listMappingsPut).Methods("PUT")
-	router.HandleFunc("/list/mappings", listMappingsDelete).Methods("DELETE")
+	router.HandleFunc("/list/mappings", s.listMappingsGet).Methods("GET")
+	router.HandleFunc("/list/mappings", s.listMappingsPost).Methods("POST")
+	router.HandleFunc("/list/mappings", s.listMappingsPut).Methods("PUT")
+	router.HandleFunc("/list/mappings", s.listMappingsDelete).Methods("DELETE")
+	router.HandleFunc("/list/mappings/expiring", s.listMappingsExpiringGet).Methods("GET")
 
-	router.HandleFunc("/isAlive", isAliveGet).Methods("GET")
+	router.HandleFunc("/list/defaults", s.listDefaultsGet).Methods("GET")
+	router.HandleFunc("/list/defaults", s.listDefaultsPost).Methods("POST")
+	router.HandleFunc("/list/defaults", s.listDefaultsPut).Methods("PUT")
+	router.HandleFunc("/list/defaults", s.listDefaultsDelete).Methods("DELETE")
 
-	portString := ":" + strconv.Itoa(*port)
-	log.Fatal(http.ListenAndServe(portString, RequestLogger(router)))
+	router.HandleFunc("/list/contexts", s.listContextsGet).Methods("GET")
+	router.HandleFunc("/list/contexts", s.listContextsPost).Methods("POST")
+	router.HandleFunc("/list/contexts", s.listContextsPut).Methods("PUT")
+	router.HandleFunc("/list/contexts", s.listContextsDelete).Methods("DELETE")
+
+	router.HandleFunc("/list/audit", s.listAuditGet).Methods("GET")
+	router.HandleFunc("/list/audit/export", s.listAuditExportGet).Methods("GET")
+	router.HandleFunc("/list/audit/verify", s.listAuditVerifyGet).Methods("GET")
+
+	router.HandleFunc("/list/explain", s.listExplainPost).Methods("POST")
+	router.HandleFunc("/list/cache", listCacheGet).Methods("GET")
+
+	router.HandleFunc("/isAlive", isAliveGet).Methods("GET")
+	router.HandleFunc("/livez", livezGet).Methods("GET")
+	router.HandleFunc("/readyz", s.readyzGet).Methods("GET")
+	router.HandleFunc("/health", s.healthGet).Methods("GET")
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	config := s.currentConfig()
+	httpServer := &http.Server{
+		Addr:              ":" + strconv.Itoa(config.port),
+		Handler:           tracedHandler(RequestLogger(instrumentRequests(router))),
+		ReadTimeout:       config.httpReadTimeout,
+		ReadHeaderTimeout: config.httpReadHeaderTimeout,
+		WriteTimeout:      config.httpWriteTimeout,
+		IdleTimeout:       config.httpIdleTimeout,
+		MaxHeaderBytes:    config.httpMaxHeaderBytes,
+	}
+
+	serverErrors := make(chan error, 1)
+	go func() {
+		serverErrors <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErrors:
+		return err
+	case <-ctx.Done():
+	}
+
+	Logger.Info("Shutting down, waiting for running requests")
+	health.shuttingDown.Store(true)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.shutdownTimeout)
+	defer cancel()
+	err := httpServer.Shutdown(shutdownCtx)
+	if err != nil {
+		httpServer.Close()
+		return fmt.Errorf("Requests still running after %v were aborted: %v", config.shutdownTimeout, err)
+	}
+	return nil
 }
 
-func claimsGet(w http.ResponseWriter, r *http.Request) {
+func (s *server) claimsGet(w http.ResponseWriter, r *http.Request) {
 	// Get config
-	config, _ := getConfig()
+	config := s.currentConfig()
+	requestTime := time.Now()
+
+	// The whole request, including all policy evaluations, is bounded by CLAIMS_TIMEOUT
+	ctx, cancel := context.WithTimeout(r.Context(), config.claimsTimeout)
+	defer cancel()
 
 	w.Header().Set("Content-Type", "application/json")
 	// Get query params
 	noContext := false
-	context := r.URL.Query().Get("context")
-	if len(context) == 0 {
+	contextId := r.URL.Query().Get("context")
+	if len(contextId) == 0 {
 		noContext = true
 	}
 
 	// Auth check
 	token, err := GetToken(r, config.identityProviderOidURL)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(401)
 		json.NewEncoder(w).Encode(err.Error())
 
@@ -79,201 +226,354 @@ func claimsGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get token's roles
-	tokenPayload, _ := json.Marshal(token.Claims.(jwt.MapClaims))
-	var tokenData interface{}
-	err = json.Unmarshal(tokenPayload, &tokenData)
-	roles, err := jsonpath.Read(tokenData, config.tokenRolesPath)
-	if roles == nil {
-		err := "Invalid or missing roles."
-		responseBody := []byte(`{"error": {"message": "` + err + `"}}`)
-		var responseJson map[string]interface{}
-		w.WriteHeader(409)
-		json.Unmarshal(responseBody, &responseJson)
-		json.NewEncoder(w).Encode(responseJson)
+	tokenData := tokenPayloadData(token)
+	rolesArray, err := readTokenRoles(tokenData, config.tokenRolesPath)
+	if err != nil {
+		writeErrorMessage(w, 409, "Invalid or missing roles.")
+		return
+	}
 
+	contexts := []string{contextId}
+	if noContext {
+		// Get token's contexts
+		contexts, err = readTokenContexts(tokenData, config.tokenContextPath)
+		if err != nil {
+			writeErrorMessage(w, 409, "Invalid or missing context in token.")
+			return
+		}
+	}
+
+	results, err := resolveContexts(ctx, config, contexts, rolesArray, tokenData, r, token.Raw, requestTime)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		if ctx.Err() == context.DeadlineExceeded {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(500)
 		return
 	}
-	var rolesArray []string
-	for _, role := range roles.([]interface{}) {
-		rolesArray = append(rolesArray, role.(string))
+
+	responseBody := []contextClaimsResponse{}
+	for _, result := range results {
+		responseBody = append(responseBody, result.response())
 	}
 
-	var responseBody []interface{}
+	json.NewEncoder(w).Encode(responseBody)
+	return
+}
 
-	if noContext {
-		// Get token's context
-		tokenContext, err := jsonpath.Read(tokenData, config.tokenContextPath)
-		if tokenContext == nil {
-			err := "Invalid or missing context in token."
-			responseBody := []byte(`{"error": {"message": "` + err + `"}}`)
-			var responseJson map[string]interface{}
-			w.WriteHeader(409)
-			json.Unmarshal(responseBody, &responseJson)
-			json.NewEncoder(w).Encode(responseJson)
+func (s *server) claimsExplainGet(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+	requestTime := time.Now()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Auth check
+	token, err := GetToken(r, config.identityProviderOidURL)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(err.Error())
+
+		return
+	}
 
+	// Get token's roles and contexts
+	tokenData := tokenPayloadData(token)
+	rolesArray, err := readTokenRoles(tokenData, config.tokenRolesPath)
+	if err != nil {
+		writeErrorMessage(w, 409, "Invalid or missing roles.")
+		return
+	}
+	contexts := []string{r.URL.Query().Get("context")}
+	if len(contexts[0]) == 0 {
+		contexts, err = readTokenContexts(tokenData, config.tokenContextPath)
+		if err != nil {
+			writeErrorMessage(w, 409, "Invalid or missing context in token.")
 			return
 		}
+	}
 
-		// Get DB claims
-		claims, err := dbListContextRolesClaims(config, tokenContext.(string), rolesArray)
+	// Like /claims, every context of the token is explained
+	explanations := []contextExplanation{}
+	for _, context := range contexts {
+		explanation, err := explainContext(r.Context(), config, context, rolesArray, conditionAttributes(tokenData, r, context, requestTime), token.Raw, requestTime)
 		if err != nil {
-			Logger.Error(err)
-			w.WriteHeader(500)
+			requestLogger(r.Context()).Error(err)
+			writeErrorMessage(w, 500, err.Error())
 			return
 		}
+		explanations = append(explanations, explanation)
+	}
 
-		if len(claims) == 0 {
-			contextClaims := make(map[string]interface{})
-			contextClaims["context"] = tokenContext.(string)
-			contextClaims["claims"] = make([]interface{}, 0)
-			responseBody = append(responseBody, contextClaims)
-		} else {
-			for _, claim := range claims {
-				/*exist := false
-				for index, cont := range responseBody {
-					if cont.(map[string]interface{})["context"] == claim.Context {
-						exist = true
-
-						contextPolicyURL := getContextPolicyURL(claim.Context)
-						if len(contextPolicyURL) > 0 {
-							claimsString := []string{claim.Claim}
-							tsaClaims, err := tsaGetContextClaimsRequest(contextPolicyURL, claim.Context, claimsString, token.Raw)
-							if err != nil {
-								Logger.Error(err)
-								w.WriteHeader(500)
-								return
-							}
-
-							for _, tsaClaim := range tsaClaims["claims"].([]string) {
-								if claim.Claim == tsaClaim {
-									responseBody[index].(map[string]interface{})["claims"] = append(responseBody[index].(map[string]interface{})["claims"].([]interface{}), claim)
-								}
-							}
-						} else {
-							responseBody[index].(map[string]interface{})["claims"] = append(responseBody[index].(map[string]interface{})["claims"].([]interface{}), claim)
-						}
-					}
-				}*/
-				//	if exist == false {
-				contextClaims := make(map[string]interface{})
-				contextClaims["context"] = claim.Context
-				var claims []interface{}
-				contextPolicyURL := getContextPolicyURL(claim.Context)
-				if len(contextPolicyURL) > 0 {
-					claimsString := []string{claim.Claim}
-					tsaClaims, err := tsaGetContextClaimsRequest(contextPolicyURL, claim.Context, claimsString, token.Raw)
-					if err != nil {
-						Logger.Error(err)
-						w.WriteHeader(500)
-						return
-					}
-
-					for _, tsaClaim := range tsaClaims["claims"].([]string) {
-						if claim.Claim == tsaClaim {
-							claims = append(claims, claim)
-							contextClaims["claims"] = claims
-
-							responseBody = append(responseBody, contextClaims)
-						}
-					}
-				} else {
-					claims = append(claims, claim)
-					contextClaims["claims"] = claims
-
-					responseBody = append(responseBody, contextClaims)
-				}
-				//	}
-			}
-		}
-		// Append default claims
-		if len(config.defaultClaims) > 0 {
-			for index, contextClaims := range responseBody {
-				for _, claimConfig := range config.defaultClaims {
-					if claimConfig.Context == tokenContext.(string) || claimConfig.Context == "*" {
-						hasRole := hasRole(rolesArray, claimConfig.Roles)
-						if hasRole {
-							currentClaims := contextClaims.(map[string]interface{})["claims"].([]interface{})
-							for _, defaultClaim := range claimConfig.Claims {
-								added := false
-								for _, claim := range currentClaims {
-									if defaultClaim == claim.(contextClaim).Claim {
-										added = true
-									}
-								}
-								if !added {
-									newClaim := contextClaim{
-										Id:      0,
-										Claim:   defaultClaim,
-										RowVer:  0,
-										Context: tokenContext.(string),
-									}
-									currentClaims = append(currentClaims, newClaim)
-									newContextClaim := make(map[string]interface{})
-									newContextClaim["context"] = tokenContext.(string)
-									newContextClaim["claims"] = currentClaims
-									responseBody[index] = newContextClaim
-								}
-							}
-						}
-					}
-				}
-			}
-		}
-	} else {
-		// Get DB claims
-		claims, err := dbListContextRolesClaims(config, context, rolesArray)
+	json.NewEncoder(w).Encode(explanations)
+	return
+}
+
+// listExplainPost explains the resolution for an arbitrary subject given by its roles, context and,
+// for mapping conditions, token payload. Policies are evaluated with the caller's token as requestor.
+func (s *server) listExplainPost(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+	requestTime := time.Now()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Auth check
+	token, err := GetToken(r, config.identityProviderOidURL)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(err.Error())
+
+		return
+	}
+
+	var payload struct {
+		Context string                 `json:"context"`
+		Roles   []string               `json:"roles"`
+		Token   map[string]interface{} `json:"token"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(payload.Context) == 0 {
+		http.Error(w, "Missing or invalid parameter \"context\"", http.StatusBadRequest)
+		return
+	}
+	if payload.Roles == nil {
+		http.Error(w, "Missing or invalid parameter \"roles\"", http.StatusBadRequest)
+		return
+	}
+
+	explanation, err := explainContext(r.Context(), config, payload.Context, payload.Roles, conditionAttributes(payload.Token, r, payload.Context, requestTime), token.Raw, requestTime)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		writeErrorMessage(w, 500, err.Error())
+		return
+	}
+
+	json.NewEncoder(w).Encode(explanation)
+	return
+}
+
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+	tokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// tokenExchangePost implements RFC 8693 token exchange: the user's access token (subject_token) is
+// exchanged for a short-lived JWT signed by this service carrying the resolved claims of a context.
+func (s *server) tokenExchangePost(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+	requestTime := time.Now()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	err := r.ParseForm()
+	if err != nil {
+		writeOAuthError(w, "invalid_request", "Invalid form body.")
+		return
+	}
+	if r.PostForm.Get("grant_type") != tokenExchangeGrantType {
+		writeOAuthError(w, "unsupported_grant_type", "Only token exchange is supported.")
+		return
+	}
+	subjectTokenType := r.PostForm.Get("subject_token_type")
+	if subjectTokenType != tokenTypeAccessToken && subjectTokenType != tokenTypeJWT {
+		writeOAuthError(w, "invalid_request", "Invalid parameter subject_token_type.")
+		return
+	}
+	requestedTokenType := r.PostForm.Get("requested_token_type")
+	if len(requestedTokenType) > 0 && requestedTokenType != tokenTypeJWT {
+		writeOAuthError(w, "invalid_request", "Invalid parameter requested_token_type.")
+		return
+	}
+
+	// Auth check
+	token, err := parseToken(r.Context(), r.PostForm.Get("subject_token"), config.identityProviderOidURL)
+	if err != nil || !token.Valid {
+		writeOAuthError(w, "invalid_request", "Invalid subject_token.")
+		return
+	}
+
+	// Get token's roles and context
+	tokenData := tokenPayloadData(token)
+	rolesArray, err := readTokenRoles(tokenData, config.tokenRolesPath)
+	if err != nil {
+		writeOAuthError(w, "invalid_request", "Invalid or missing roles in subject_token.")
+		return
+	}
+	context := r.PostForm.Get("context")
+	if len(context) == 0 {
+		// A token is issued for one context, a subject_token with several has to name it
+		tokenContexts, err := readTokenContexts(tokenData, config.tokenContextPath)
 		if err != nil {
-			Logger.Error(err)
-			w.WriteHeader(500)
+			writeOAuthError(w, "invalid_request", "Invalid or missing context.")
 			return
 		}
-		contextClaims := make(map[string]interface{})
+		if len(tokenContexts) > 1 {
+			writeOAuthError(w, "invalid_request", "Missing parameter context, the subject_token has several contexts.")
+			return
+		}
+		context = tokenContexts[0]
+	}
 
-		contextPolicyURL := getContextPolicyURL(context)
-		if len(contextPolicyURL) > 0 {
-			var claimsString []string
-			for _, claim := range claims {
-				claimsString = append(claimsString, claim.Claim)
-			}
-			tsaClaims, err := tsaGetContextClaimsRequest(contextPolicyURL, context, claimsString, token.Raw)
-			if err != nil {
-				Logger.Error(err)
-				w.WriteHeader(500)
-				return
-			}
+	result, _, err := resolveContext(r.Context(), config, context, rolesArray, conditionAttributes(tokenData, r, context, requestTime), token.Raw, requestTime)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
 
-			contextClaims["context"] = context
-			var finalClaims []interface{}
-			for _, claim := range claims {
-				for _, tsaClaim := range tsaClaims["claims"].([]string) {
-					if claim.Claim == tsaClaim {
-						finalClaims = append(finalClaims, claim)
-					}
-				}
-			}
-			contextClaims["claims"] = finalClaims
-		} else {
-			contextClaims["context"] = context
-			contextClaims["claims"] = claims
-		}
+	tokenClaims := jwt.MapClaims{
+		"iss":     tokenIssuer(config),
+		"iat":     requestTime.Unix(),
+		"nbf":     requestTime.Unix(),
+		"exp":     requestTime.Add(config.tokenLifetime).Unix(),
+		"jti":     uuid.New().String(),
+		"context": context,
+		"claims":  result.response().Claims,
+	}
+	if subject, ok := tokenData.(map[string]interface{})["sub"]; ok {
+		tokenClaims["sub"] = subject
+	}
+	audience := append(r.PostForm["audience"], r.PostForm["resource"]...)
+	if len(audience) > 0 {
+		tokenClaims["aud"] = audience
+	}
 
-		appendDefaultClaims(context, config.defaultClaims, contextClaims, rolesArray)
-		responseBody = append(responseBody, contextClaims)
+	signedToken, err := signingKeys.sign(tokenClaims, claimTokenType)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
 	}
 
-	json.NewEncoder(w).Encode(responseBody)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":      signedToken,
+		"issued_token_type": tokenTypeJWT,
+		"token_type":        "Bearer",
+		"expires_in":        int64(config.tokenLifetime.Seconds()),
+	})
+	return
+}
+
+// mapperClaimsPost serves identity provider protocol mappers (e.g. a Keycloak HTTP claim mapper)
+// that inject the resolved claims into tokens at issuance. The caller authenticates with client
+// credentials and passes the user's subject, roles and context. As there is no user token yet,
+// conditions see the subject, roles and context as token payload and policies get no requestor.
+func (s *server) mapperClaimsPost(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+	requestTime := time.Now()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Auth check
+	err := VerifyClientCredentials(r, config.mapperClientId, config.mapperClientSecret)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(err.Error())
+
+		return
+	}
+
+	var payload struct {
+		Subject string   `json:"subject"`
+		Roles   []string `json:"roles"`
+		Context string   `json:"context"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(payload.Context) == 0 {
+		http.Error(w, "Missing or invalid parameter \"context\"", http.StatusBadRequest)
+		return
+	}
+
+	tokenData := map[string]interface{}{
+		"sub":     payload.Subject,
+		"roles":   payload.Roles,
+		"context": payload.Context,
+	}
+	result, _, err := resolveContext(r.Context(), config, payload.Context, payload.Roles, conditionAttributes(tokenData, r, payload.Context, requestTime), "", requestTime)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	claims := []string{}
+	for _, claim := range result.Claims {
+		claims = append(claims, claim.Claim)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"context": payload.Context,
+		"claims":  claims,
+	})
+	return
+}
+
+func jwksGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(signingKeys.jwks())
+	return
+}
+
+func (s *server) openidConfigurationGet(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Without an issuer there are no tokens to discover
+	issuer := tokenIssuer(config)
+	if len(issuer) == 0 {
+		w.WriteHeader(404)
+		return
+	}
+	discovery := map[string]interface{}{
+		"issuer":                                issuer,
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"id_token_signing_alg_values_supported": []string{jwt.SigningMethodRS256.Alg()},
+	}
+	if config.tokenExchangeEnabled {
+		discovery["token_endpoint"] = issuer + "/token"
+		discovery["grant_types_supported"] = []string{tokenExchangeGrantType}
+		discovery["token_endpoint_auth_methods_supported"] = []string{"none"}
+	}
+	json.NewEncoder(w).Encode(discovery)
 	return
 }
 
-func listRolesGet(w http.ResponseWriter, r *http.Request) {
+// tokenIssuer returns TOKEN_ISSUER, it is never taken from the request as callers control the
+// Host and X-Forwarded-Proto headers
+func tokenIssuer(config config) string {
+	return strings.TrimSuffix(config.tokenIssuer, "/")
+}
+
+func (s *server) listRolesGet(w http.ResponseWriter, r *http.Request) {
 	// Get config
-	config, _ := getConfig()
+	config := s.currentConfig()
 
 	w.Header().Set("Content-Type", "application/json")
 
-	roles, err := dbListRoles(config)
+	roles, err := dbListRoles(r.Context(), config)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -282,16 +582,16 @@ func listRolesGet(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func listRolesPost(w http.ResponseWriter, r *http.Request) {
+func (s *server) listRolesPost(w http.ResponseWriter, r *http.Request) {
 	// Get config
-	config, _ := getConfig()
+	config := s.currentConfig()
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Auth check
 	err := VerifyToken(r, config.identityProviderOidURL)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(401)
 		json.NewEncoder(w).Encode(err.Error())
 
@@ -310,9 +610,9 @@ func listRolesPost(w http.ResponseWriter, r *http.Request) {
 		rolesNames = append(rolesNames, role.Role)
 	}
 
-	err = dbInsertRoles(config, rolesNames)
+	err = dbInsertRoles(r.Context(), config, rolesNames)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -322,16 +622,16 @@ func listRolesPost(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func listRolesPut(w http.ResponseWriter, r *http.Request) {
+func (s *server) listRolesPut(w http.ResponseWriter, r *http.Request) {
 	// Get config
-	config, _ := getConfig()
+	config := s.currentConfig()
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Auth check
 	err := VerifyToken(r, config.identityProviderOidURL)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(401)
 		json.NewEncoder(w).Encode(err.Error())
 
@@ -353,7 +653,7 @@ func listRolesPut(w http.ResponseWriter, r *http.Request) {
 
 	idNumber, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		err := "Invalid parameter id."
 		responseBody := []byte(`{"error": {"message": "` + err + `"}}`)
 		var responseJson map[string]interface{}
@@ -388,9 +688,9 @@ func listRolesPut(w http.ResponseWriter, r *http.Request) {
 		RowVer: int64(rowVersion),
 	}
 
-	err = dbUpdateRole(config, updatedRole)
+	err = dbUpdateRole(r.Context(), config, updatedRole)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -398,16 +698,16 @@ func listRolesPut(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func listRolesDelete(w http.ResponseWriter, r *http.Request) {
+func (s *server) listRolesDelete(w http.ResponseWriter, r *http.Request) {
 	// Get config
-	config, _ := getConfig()
+	config := s.currentConfig()
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Auth check
 	err := VerifyToken(r, config.identityProviderOidURL)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(401)
 		json.NewEncoder(w).Encode(err.Error())
 
@@ -429,7 +729,7 @@ func listRolesDelete(w http.ResponseWriter, r *http.Request) {
 
 	idNumber, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		err := "Invalid parameter id."
 		responseBody := []byte(`{"error": {"message": "` + err + `"}}`)
 		var responseJson map[string]interface{}
@@ -440,9 +740,9 @@ func listRolesDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = dbDeleteRole(config, idNumber)
+	err = dbDeleteRole(r.Context(), config, idNumber)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -450,15 +750,15 @@ func listRolesDelete(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func listClaimsGet(w http.ResponseWriter, r *http.Request) {
+func (s *server) listClaimsGet(w http.ResponseWriter, r *http.Request) {
 	// Get config
-	config, _ := getConfig()
+	config := s.currentConfig()
 
 	w.Header().Set("Content-Type", "application/json")
 
-	claims, err := dbListClaims(config)
+	claims, err := dbListClaims(r.Context(), config)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -467,16 +767,16 @@ func listClaimsGet(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func listClaimsPost(w http.ResponseWriter, r *http.Request) {
+func (s *server) listClaimsPost(w http.ResponseWriter, r *http.Request) {
 	// Get config
-	config, _ := getConfig()
+	config := s.currentConfig()
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Auth check
 	err := VerifyToken(r, config.identityProviderOidURL)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(401)
 		json.NewEncoder(w).Encode(err.Error())
 
@@ -490,14 +790,18 @@ func listClaimsPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var claimsNames []string
-	for _, claim := range newClaims {
-		claimsNames = append(claimsNames, claim.Claim)
+	// Check value parameters
+	for _, newClaim := range newClaims {
+		err = validateClaimValue(newClaim.ValueSchema, newClaim.Value)
+		if err != nil {
+			http.Error(w, "Invalid parameter \"value\" of claim \""+newClaim.Claim+"\": "+err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
-	err = dbInsertClaims(config, claimsNames)
+	err = dbInsertClaims(r.Context(), config, newClaims)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -507,16 +811,16 @@ func listClaimsPost(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func listClaimsPut(w http.ResponseWriter, r *http.Request) {
+func (s *server) listClaimsPut(w http.ResponseWriter, r *http.Request) {
 	// Get config
-	config, _ := getConfig()
+	config := s.currentConfig()
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Auth check
 	err := VerifyToken(r, config.identityProviderOidURL)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(401)
 		json.NewEncoder(w).Encode(err.Error())
 
@@ -538,7 +842,7 @@ func listClaimsPut(w http.ResponseWriter, r *http.Request) {
 
 	idNumber, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		err := "Invalid parameter id."
 		responseBody := []byte(`{"error": {"message": "` + err + `"}}`)
 		var responseJson map[string]interface{}
@@ -567,15 +871,44 @@ func listClaimsPut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	description, _ := payload["description"].(string)
+	category, _ := payload["category"].(string)
+	deprecated, _ := payload["deprecated"].(bool)
+	valueSchema, err := optionalJSON(payload["valueSchema"])
+	if err != nil {
+		http.Error(w, "Invalid parameter \"valueSchema\"", http.StatusBadRequest)
+		return
+	}
+	value, err := optionalJSON(payload["value"])
+	if err != nil {
+		http.Error(w, "Invalid parameter \"value\"", http.StatusBadRequest)
+		return
+	}
+	err = validateClaimValue(valueSchema, value)
+	if err != nil {
+		http.Error(w, "Invalid parameter \"value\": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	updatedClaim := claim{
-		Id:     idNumber,
-		Claim:  claimName,
-		RowVer: int64(rowVersion),
+		Id:          idNumber,
+		Claim:       claimName,
+		RowVer:      int64(rowVersion),
+		Description: description,
+		Category:    category,
+		Deprecated:  deprecated,
+		ValueSchema: valueSchema,
+		Value:       value,
 	}
 
-	err = dbUpdateClaim(config, updatedClaim)
+	err = dbUpdateClaim(r.Context(), config, updatedClaim)
+	var valueError *mappingValueError
+	if errors.As(err, &valueError) {
+		writeErrorMessage(w, http.StatusUnprocessableEntity, "Invalid parameter valueSchema, "+valueError.Error()+".")
+		return
+	}
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -583,16 +916,16 @@ func listClaimsPut(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func listClaimsDelete(w http.ResponseWriter, r *http.Request) {
+func (s *server) listClaimsDelete(w http.ResponseWriter, r *http.Request) {
 	// Get config
-	config, _ := getConfig()
+	config := s.currentConfig()
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Auth check
 	err := VerifyToken(r, config.identityProviderOidURL)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(401)
 		json.NewEncoder(w).Encode(err.Error())
 
@@ -614,7 +947,7 @@ func listClaimsDelete(w http.ResponseWriter, r *http.Request) {
 
 	idNumber, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		err := "Invalid parameter id."
 		responseBody := []byte(`{"error": {"message": "` + err + `"}}`)
 		var responseJson map[string]interface{}
@@ -625,9 +958,9 @@ func listClaimsDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = dbDeleteClaim(config, idNumber)
+	err = dbDeleteClaim(r.Context(), config, idNumber)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -635,15 +968,15 @@ func listClaimsDelete(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func listMappingsGet(w http.ResponseWriter, r *http.Request) {
+func (s *server) listMappingsGet(w http.ResponseWriter, r *http.Request) {
 	// Get config
-	config, _ := getConfig()
+	config := s.currentConfig()
 
 	w.Header().Set("Content-Type", "application/json")
 
-	mappings, err := dbListMappings(config)
+	mappings, err := dbListMappings(r.Context(), config)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -652,16 +985,16 @@ func listMappingsGet(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func listMappingsPost(w http.ResponseWriter, r *http.Request) {
+func (s *server) listMappingsPost(w http.ResponseWriter, r *http.Request) {
 	// Get config
-	config, _ := getConfig()
+	config := s.currentConfig()
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Auth check
 	err := VerifyToken(r, config.identityProviderOidURL)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(401)
 		json.NewEncoder(w).Encode(err.Error())
 
@@ -675,11 +1008,36 @@ func listMappingsPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check context and effect parameters
+	for index := range newMappings {
+		err = applyContextPattern(&newMappings[index])
+		if err != nil {
+			http.Error(w, "Invalid parameter \"context\": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(newMappings[index].Effect) == 0 {
+			newMappings[index].Effect = mappingEffectAllow
+		}
+		if !isValidMappingEffect(newMappings[index].Effect) {
+			http.Error(w, "Invalid parameter \"effect\"", http.StatusBadRequest)
+			return
+		}
+		if !isValidMappingWindow(newMappings[index].ValidFrom, newMappings[index].ValidUntil) {
+			http.Error(w, "Invalid parameter \"validUntil\", must be after \"validFrom\"", http.StatusBadRequest)
+			return
+		}
+		err = validateCondition(newMappings[index].Condition)
+		if err != nil {
+			http.Error(w, "Invalid parameter \"condition\": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Check claims and roles parameters
 	exist := false
-	claims, err := dbListClaims(config)
+	claims, err := dbListClaims(r.Context(), config)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -687,6 +1045,12 @@ func listMappingsPost(w http.ResponseWriter, r *http.Request) {
 		for _, claim := range claims {
 			if newMapping.Claim_Id == claim.Id {
 				exist = true
+
+				err = validateClaimValue(claim.ValueSchema, newMapping.Value)
+				if err != nil {
+					http.Error(w, "Invalid parameter \"value\": "+err.Error(), http.StatusBadRequest)
+					return
+				}
 			}
 		}
 		if !exist {
@@ -695,9 +1059,9 @@ func listMappingsPost(w http.ResponseWriter, r *http.Request) {
 		}
 		exist = false
 	}
-	roles, err := dbListRoles(config)
+	roles, err := dbListRoles(r.Context(), config)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -714,9 +1078,9 @@ func listMappingsPost(w http.ResponseWriter, r *http.Request) {
 		exist = false
 	}
 
-	err = dbInsertMappings(config, newMappings)
+	err = dbInsertMappings(r.Context(), config, newMappings)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -726,16 +1090,16 @@ func listMappingsPost(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func listMappingsPut(w http.ResponseWriter, r *http.Request) {
+func (s *server) listMappingsPut(w http.ResponseWriter, r *http.Request) {
 	// Get config
-	config, _ := getConfig()
+	config := s.currentConfig()
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Auth check
 	err := VerifyToken(r, config.identityProviderOidURL)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(401)
 		json.NewEncoder(w).Encode(err.Error())
 
@@ -757,7 +1121,7 @@ func listMappingsPut(w http.ResponseWriter, r *http.Request) {
 
 	mappingId, err := uuid.Parse(id)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		err := "Invalid parameter id."
 		responseBody := []byte(`{"error": {"message": "` + err + `"}}`)
 		var responseJson map[string]interface{}
@@ -805,28 +1169,109 @@ func listMappingsPut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing or invalid parameter \"rowversion\"", http.StatusBadRequest)
 		return
 	}
-
-	updatedMapping := mapping{
-		Id:          mappingId,
-		Context:     context,
+	// Optional fields left out of the body keep their stored value, null clears them
+	storedMapping, found, err := dbGetMapping(r.Context(), config, mappingId)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+	if !found {
+		writeErrorMessage(w, 409, "Invalid parameter id.")
+		return
+	}
+	effect := storedMapping.Effect
+	if payload["effect"] != nil {
+		effect, ok = payload["effect"].(string)
+		if !ok || !isValidMappingEffect(effect) {
+			http.Error(w, "Invalid parameter \"effect\"", http.StatusBadRequest)
+			return
+		}
+	}
+	validFrom := storedMapping.ValidFrom
+	if _, present := payload["validFrom"]; present {
+		validFrom, err = parseOptionalTime(payload["validFrom"])
+		if err != nil {
+			http.Error(w, "Invalid parameter \"validFrom\"", http.StatusBadRequest)
+			return
+		}
+	}
+	validUntil := storedMapping.ValidUntil
+	if _, present := payload["validUntil"]; present {
+		validUntil, err = parseOptionalTime(payload["validUntil"])
+		if err != nil {
+			http.Error(w, "Invalid parameter \"validUntil\"", http.StatusBadRequest)
+			return
+		}
+	}
+	if !isValidMappingWindow(validFrom, validUntil) {
+		http.Error(w, "Invalid parameter \"validUntil\", must be after \"validFrom\"", http.StatusBadRequest)
+		return
+	}
+	value := storedMapping.Value
+	if _, present := payload["value"]; present {
+		value, err = optionalJSON(payload["value"])
+		if err != nil {
+			http.Error(w, "Invalid parameter \"value\"", http.StatusBadRequest)
+			return
+		}
+	}
+	condition := storedMapping.Condition
+	if _, present := payload["condition"]; present {
+		condition = ""
+		if payload["condition"] != nil {
+			condition, ok = payload["condition"].(string)
+			if !ok {
+				http.Error(w, "Invalid parameter \"condition\"", http.StatusBadRequest)
+				return
+			}
+		}
+		err = validateCondition(condition)
+		if err != nil {
+			http.Error(w, "Invalid parameter \"condition\": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	updatedMapping := mapping{
+		Id:          mappingId,
+		Context:     context,
 		Claim_Id:    int64(claimId),
 		Role_Id:     int64(roleId),
 		Name:        name,
 		Description: desc,
 		RowVer:      int64(rowVersion),
+		Effect:      effect,
+		ValidFrom:   validFrom,
+		ValidUntil:  validUntil,
+		Condition:   condition,
+		Value:       value,
+	}
+
+	// Check context parameter
+	err = applyContextPattern(&updatedMapping)
+	if err != nil {
+		http.Error(w, "Invalid parameter \"context\": "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	// Check claims and roles parameters
 	exist := false
-	claims, err := dbListClaims(config)
+	claims, err := dbListClaims(r.Context(), config)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
 	for _, claim := range claims {
 		if updatedMapping.Claim_Id == claim.Id {
 			exist = true
+
+			err = validateClaimValue(claim.ValueSchema, updatedMapping.Value)
+			if err != nil {
+				http.Error(w, "Invalid parameter \"value\": "+err.Error(), http.StatusBadRequest)
+				return
+			}
 		}
 	}
 	if !exist {
@@ -835,9 +1280,9 @@ func listMappingsPut(w http.ResponseWriter, r *http.Request) {
 	}
 	exist = false
 
-	roles, err := dbListRoles(config)
+	roles, err := dbListRoles(r.Context(), config)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -851,26 +1296,62 @@ func listMappingsPut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = dbUpdateMapping(config, updatedMapping)
+	err = dbUpdateMapping(r.Context(), config, updatedMapping)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	return
+}
+
+func (s *server) listMappingsExpiringGet(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get query params
+	within := 7 * 24 * time.Hour
+	withinParam := r.URL.Query().Get("within")
+	if len(withinParam) > 0 {
+		duration, err := time.ParseDuration(withinParam)
+		if err != nil || duration <= 0 {
+			err := "Invalid parameter within."
+			responseBody := []byte(`{"error": {"message": "` + err + `"}}`)
+			var responseJson map[string]interface{}
+			w.WriteHeader(409)
+			json.Unmarshal(responseBody, &responseJson)
+			json.NewEncoder(w).Encode(responseJson)
+
+			return
+		}
+		within = duration
+	}
+
+	now := time.Now()
+	mappings, err := dbListExpiringMappings(r.Context(), config, now, now.Add(within))
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
 
+	json.NewEncoder(w).Encode(mappings)
 	return
 }
 
-func listMappingsDelete(w http.ResponseWriter, r *http.Request) {
+func (s *server) listMappingsDelete(w http.ResponseWriter, r *http.Request) {
 	// Get config
-	config, _ := getConfig()
+	config := s.currentConfig()
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Auth check
 	err := VerifyToken(r, config.identityProviderOidURL)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(401)
 		json.NewEncoder(w).Encode(err.Error())
 
@@ -892,7 +1373,7 @@ func listMappingsDelete(w http.ResponseWriter, r *http.Request) {
 
 	mappingId, err := uuid.Parse(id)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		err := "Invalid parameter id."
 		responseBody := []byte(`{"error": {"message": "` + err + `"}}`)
 		var responseJson map[string]interface{}
@@ -903,9 +1384,388 @@ func listMappingsDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = dbDeleteMapping(config, mappingId)
+	err = dbDeleteMapping(r.Context(), config, mappingId)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	return
+}
+
+func (s *server) listDefaultsGet(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	defaultClaims, err := dbListDefaultClaims(r.Context(), config)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(defaultClaims)
+	return
+}
+
+func (s *server) listDefaultsPost(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Auth check
+	err := VerifyToken(r, config.identityProviderOidURL)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(err.Error())
+
+		return
+	}
+
+	var newDefaultClaims []defaultClaim
+	err = json.NewDecoder(r.Body).Decode(&newDefaultClaims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check context, roles and claims parameters
+	for index := range newDefaultClaims {
+		err = applyDefaultClaimContextPattern(&newDefaultClaims[index])
+		if err != nil {
+			http.Error(w, "Invalid parameter \"context\": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(newDefaultClaims[index].Roles) == 0 {
+			http.Error(w, "Missing or invalid parameter \"roles\"", http.StatusBadRequest)
+			return
+		}
+		if len(newDefaultClaims[index].Claims) == 0 {
+			http.Error(w, "Missing or invalid parameter \"claims\"", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = dbInsertDefaultClaims(r.Context(), config, newDefaultClaims)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.WriteHeader(201)
+
+	return
+}
+
+func (s *server) listDefaultsPut(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Auth check
+	err := VerifyToken(r, config.identityProviderOidURL)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(err.Error())
+
+		return
+	}
+
+	// Get query params
+	id := r.URL.Query().Get("id")
+	idNumber, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		writeErrorMessage(w, 409, "Invalid parameter id.")
+		return
+	}
+
+	// Get body params
+	var payload map[string]interface{}
+	err = json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	context, ok := payload["context"].(string)
+	if !ok {
+		http.Error(w, "Missing or invalid parameter \"context\"", http.StatusBadRequest)
+		return
+	}
+	roles, ok := stringList(payload["roles"])
+	if !ok || len(roles) == 0 {
+		http.Error(w, "Missing or invalid parameter \"roles\"", http.StatusBadRequest)
+		return
+	}
+	claims, ok := stringList(payload["claims"])
+	if !ok || len(claims) == 0 {
+		http.Error(w, "Missing or invalid parameter \"claims\"", http.StatusBadRequest)
+		return
+	}
+	desc := ""
+	if payload["desc"] != nil {
+		desc, ok = payload["desc"].(string)
+		if !ok {
+			http.Error(w, "Invalid parameter \"desc\"", http.StatusBadRequest)
+			return
+		}
+	}
+	rowVersion, ok := payload["rowversion"].(float64)
+	if !ok {
+		http.Error(w, "Missing or invalid parameter \"rowversion\"", http.StatusBadRequest)
+		return
+	}
+
+	updatedDefaultClaim := defaultClaim{
+		Id:          idNumber,
+		Context:     context,
+		Roles:       roles,
+		Claims:      claims,
+		Description: desc,
+		RowVer:      int64(rowVersion),
+	}
+
+	// Check context parameter
+	err = applyDefaultClaimContextPattern(&updatedDefaultClaim)
+	if err != nil {
+		http.Error(w, "Invalid parameter \"context\": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = dbUpdateDefaultClaim(r.Context(), config, updatedDefaultClaim)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	return
+}
+
+func (s *server) listDefaultsDelete(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Auth check
+	err := VerifyToken(r, config.identityProviderOidURL)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(err.Error())
+
+		return
+	}
+
+	// Get query params
+	id := r.URL.Query().Get("id")
+	idNumber, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		writeErrorMessage(w, 409, "Invalid parameter id.")
+		return
+	}
+
+	err = dbDeleteDefaultClaim(r.Context(), config, idNumber)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	return
+}
+
+func (s *server) listContextsGet(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	contexts, err := dbListContextSettings(r.Context(), config)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(contexts)
+	return
+}
+
+func (s *server) listContextsPost(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Auth check
+	err := VerifyToken(r, config.identityProviderOidURL)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(err.Error())
+
+		return
+	}
+
+	var newContexts []contextSettings
+	err = json.NewDecoder(r.Body).Decode(&newContexts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for index := range newContexts {
+		err = validateContextSettings(config, &newContexts[index])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = dbInsertContextSettings(r.Context(), config, newContexts)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.WriteHeader(201)
+
+	return
+}
+
+func (s *server) listContextsPut(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Auth check
+	err := VerifyToken(r, config.identityProviderOidURL)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(err.Error())
+
+		return
+	}
+
+	// Get query params
+	id := r.URL.Query().Get("id")
+	idNumber, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		writeErrorMessage(w, 409, "Invalid parameter id.")
+		return
+	}
+
+	// Get body params
+	var payload map[string]interface{}
+	err = json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	context, ok := payload["context"].(string)
+	if !ok {
+		http.Error(w, "Missing or invalid parameter \"context\"", http.StatusBadRequest)
+		return
+	}
+	rowVersion, ok := payload["rowversion"].(float64)
+	if !ok {
+		http.Error(w, "Missing or invalid parameter \"rowversion\"", http.StatusBadRequest)
+		return
+	}
+	updatedContext := contextSettings{
+		Id:        idNumber,
+		Context:   context,
+		RowVer:    int64(rowVersion),
+		Evaluator: policyEvaluatorTSA,
+		FailMode:  contextFailModeClosed,
+		Enabled:   true,
+	}
+	if payload["evaluator"] != nil {
+		updatedContext.Evaluator, ok = payload["evaluator"].(string)
+		if !ok {
+			http.Error(w, "Invalid parameter \"evaluator\"", http.StatusBadRequest)
+			return
+		}
+	}
+	if payload["policy_url"] != nil {
+		updatedContext.PolicyURL, ok = payload["policy_url"].(string)
+		if !ok {
+			http.Error(w, "Invalid parameter \"policy_url\"", http.StatusBadRequest)
+			return
+		}
+	}
+	if payload["bundle"] != nil {
+		updatedContext.Bundle, ok = payload["bundle"].(string)
+		if !ok {
+			http.Error(w, "Invalid parameter \"bundle\"", http.StatusBadRequest)
+			return
+		}
+	}
+	if payload["query"] != nil {
+		updatedContext.Query, ok = payload["query"].(string)
+		if !ok {
+			http.Error(w, "Invalid parameter \"query\"", http.StatusBadRequest)
+			return
+		}
+	}
+	if payload["requestor_mode"] != nil {
+		updatedContext.RequestorMode, ok = payload["requestor_mode"].(string)
+		if !ok {
+			http.Error(w, "Invalid parameter \"requestor_mode\"", http.StatusBadRequest)
+			return
+		}
+	}
+	if payload["timeout_ms"] != nil {
+		timeout, ok := payload["timeout_ms"].(float64)
+		if !ok {
+			http.Error(w, "Invalid parameter \"timeout_ms\"", http.StatusBadRequest)
+			return
+		}
+		updatedContext.TimeoutMs = int64(timeout)
+	}
+	if payload["fail_mode"] != nil {
+		updatedContext.FailMode, ok = payload["fail_mode"].(string)
+		if !ok {
+			http.Error(w, "Invalid parameter \"fail_mode\"", http.StatusBadRequest)
+			return
+		}
+	}
+	if payload["enabled"] != nil {
+		updatedContext.Enabled, ok = payload["enabled"].(bool)
+		if !ok {
+			http.Error(w, "Invalid parameter \"enabled\"", http.StatusBadRequest)
+			return
+		}
+	}
+	if payload["desc"] != nil {
+		updatedContext.Description, ok = payload["desc"].(string)
+		if !ok {
+			http.Error(w, "Invalid parameter \"desc\"", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = validateContextSettings(config, &updatedContext)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = dbUpdateContextSettings(r.Context(), config, updatedContext)
 	if err != nil {
-		Logger.Error(err)
+		requestLogger(r.Context()).Error(err)
 		w.WriteHeader(500)
 		return
 	}
@@ -913,8 +1773,244 @@ func listMappingsDelete(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+func (s *server) listContextsDelete(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Auth check
+	err := VerifyToken(r, config.identityProviderOidURL)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(err.Error())
+
+		return
+	}
+
+	// Get query params
+	id := r.URL.Query().Get("id")
+	idNumber, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		writeErrorMessage(w, 409, "Invalid parameter id.")
+		return
+	}
+
+	err = dbDeleteContextSettings(r.Context(), config, idNumber)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	return
+}
+
+// Audit
+
+// parseAuditFilter reads the filters of the audit endpoints, it returns the name of an invalid parameter
+func parseAuditFilter(r *http.Request) (auditFilter, string) {
+	query := r.URL.Query()
+	filter := auditFilter{
+		Entity:    query.Get("entity"),
+		EntityId:  query.Get("entity_id"),
+		Action:    query.Get("action"),
+		Subject:   query.Get("subject"),
+		RequestId: query.Get("request_id"),
+	}
+
+	for _, parameter := range []string{"from", "until"} {
+		value := query.Get(parameter)
+		if len(value) == 0 {
+			continue
+		}
+		parsedTime, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, parameter
+		}
+		if parameter == "from" {
+			filter.From = &parsedTime
+		} else {
+			filter.Until = &parsedTime
+		}
+	}
+
+	afterId := query.Get("after_id")
+	if len(afterId) > 0 {
+		afterIdNumber, err := strconv.ParseInt(afterId, 10, 64)
+		if err != nil || afterIdNumber < 0 {
+			return filter, "after_id"
+		}
+		filter.AfterId = afterIdNumber
+	}
+
+	limit := query.Get("limit")
+	if len(limit) > 0 {
+		limitNumber, err := strconv.Atoi(limit)
+		if err != nil || limitNumber <= 0 {
+			return filter, "limit"
+		}
+		filter.Limit = limitNumber
+	}
+
+	return filter, ""
+}
+
+func (s *server) listAuditGet(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Auth check
+	err := VerifyToken(r, config.identityProviderOidURL)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(err.Error())
+
+		return
+	}
+
+	// Get query params, pages are read with after_id set to the id of the last entry
+	filter, invalidParameter := parseAuditFilter(r)
+	if len(invalidParameter) > 0 {
+		writeErrorMessage(w, 409, "Invalid parameter "+invalidParameter+".")
+		return
+	}
+	if filter.Limit == 0 {
+		filter.Limit = auditDefaultLimit
+	}
+	if filter.Limit > auditMaxLimit {
+		filter.Limit = auditMaxLimit
+	}
+
+	entries, err := dbListAuditEntries(r.Context(), config, filter)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(entries)
+	return
+}
+
+// listAuditExportGet streams all matching entries as JSON lines, including the hashes for offline verification
+func (s *server) listAuditExportGet(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+
+	// Auth check
+	err := VerifyToken(r, config.identityProviderOidURL)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(err.Error())
+
+		return
+	}
+
+	filter, invalidParameter := parseAuditFilter(r)
+	if len(invalidParameter) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		writeErrorMessage(w, 409, "Invalid parameter "+invalidParameter+".")
+		return
+	}
+
+	// An export may take longer than HTTP_WRITE_TIMEOUT, the deadline is extended with every entry
+	// so that only a stalled client is cut off
+	controller := http.NewResponseController(w)
+	extendDeadline := func() error {
+		if config.httpWriteTimeout <= 0 {
+			return nil
+		}
+		return controller.SetWriteDeadline(time.Now().Add(config.httpWriteTimeout))
+	}
+	err = extendDeadline()
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"audit.jsonl\"")
+	encoder := json.NewEncoder(w)
+	err = dbForEachAuditEntry(r.Context(), config, filter, func(entry auditEntry) error {
+		err := extendDeadline()
+		if err != nil {
+			return err
+		}
+		return encoder.Encode(entry)
+	})
+	if err != nil {
+		// Entries may have been written already, the status cannot change anymore
+		requestLogger(r.Context()).Error(err)
+		return
+	}
+}
+
+func (s *server) listAuditVerifyGet(w http.ResponseWriter, r *http.Request) {
+	// Get config
+	config := s.currentConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Auth check
+	err := VerifyToken(r, config.identityProviderOidURL)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(err.Error())
+
+		return
+	}
+
+	verification, err := dbVerifyAuditChain(r.Context(), config)
+	if err != nil {
+		requestLogger(r.Context()).Error(err)
+		w.WriteHeader(500)
+		return
+	}
+	if !verification.Valid {
+		requestLogger(r.Context()).Errorf("Audit log chain is broken at entry %d", *verification.FirstInvalidId)
+	}
+
+	json.NewEncoder(w).Encode(verification)
+	return
+}
+
+func listCacheGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(resolutionCache.stats())
+	return
+}
+
 func isAliveGet(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 
 	return
 }
+
+func writeErrorMessage(w http.ResponseWriter, statusCode int, message string) {
+	responseJson := map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+		},
+	}
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(responseJson)
+}
+
+// writeOAuthError writes an RFC 6749 error response
+func writeOAuthError(w http.ResponseWriter, errorCode string, description string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":             errorCode,
+		"error_description": description,
+	})
+}
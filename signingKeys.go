@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Keys used to sign the claim tokens issued by the token exchange endpoint and requestor assertions.
+// Keys are loaded from PEM files in SIGNING_KEYS_DIR (the most recently modified file signs, all are
+// published), which all replicas share. Only with SIGNING_KEYS_EPHEMERAL, meant for development, they
+// are generated in memory and rotated every SIGNING_KEY_ROTATION, keeping the previous key published
+// so that issued tokens stay verifiable until they expire. Without either nothing can be signed.
+var signingKeys = &signingKeyManager{}
+
+type signingKey struct {
+	kid       string
+	key       *rsa.PrivateKey
+	createdAt time.Time
+}
+
+type signingKeyManager struct {
+	mutex sync.RWMutex
+	keys  []signingKey
+}
+
+func initSigningKeys(config config) error {
+	err := signingKeys.load(config)
+	if err != nil {
+		return err
+	}
+
+	if config.signingKeyRotation > 0 && (len(config.signingKeysDir) > 0 || config.signingKeysEphemeral) {
+		go func() {
+			ticker := time.NewTicker(config.signingKeyRotation)
+			for range ticker.C {
+				err := signingKeys.rotate(config)
+				if err != nil {
+					Logger.Error(err)
+				}
+			}
+		}()
+	}
+
+	return nil
+}
+
+func (m *signingKeyManager) load(config config) error {
+	if len(config.signingKeysDir) > 0 {
+		keys, err := readSigningKeys(config.signingKeysDir)
+		if err != nil {
+			return err
+		}
+		m.mutex.Lock()
+		m.keys = keys
+		m.mutex.Unlock()
+		return nil
+	}
+	if !config.signingKeysEphemeral {
+		return nil
+	}
+
+	key, err := generateSigningKey()
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.keys = []signingKey{key}
+	m.mutex.Unlock()
+	Logger.Warn("Signing keys are generated in memory, tokens are only verifiable by this replica until it restarts. Set SIGNING_KEYS_DIR outside of development.")
+	return nil
+}
+
+func (m *signingKeyManager) rotate(config config) error {
+	if len(config.signingKeysDir) > 0 {
+		return m.load(config)
+	}
+
+	key, err := generateSigningKey()
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.keys = append([]signingKey{key}, m.keys...)
+	if len(m.keys) > 2 {
+		m.keys = m.keys[:2]
+	}
+	Logger.Info("Rotated signing key, new key id " + key.kid)
+	return nil
+}
+
+func (m *signingKeyManager) activeKey() (signingKey, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if len(m.keys) == 0 {
+		return signingKey{}, fmt.Errorf("No signing key available")
+	}
+	return m.keys[0], nil
+}
+
+func (m *signingKeyManager) jwks() map[string]interface{} {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	keys := []interface{}{}
+	for _, key := range m.keys {
+		jwk := publicJWK(&key.key.PublicKey)
+		jwk["kid"] = key.kid
+		jwk["use"] = "sig"
+		jwk["alg"] = jwt.SigningMethodRS256.Alg()
+		keys = append(keys, jwk)
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+// Claim tokens and requestor assertions are signed with the same keys, the typ header tells them apart
+// so that neither is accepted as the other
+const (
+	claimTokenType      = "JWT"
+	policyAssertionType = "policy-assertion+jwt"
+)
+
+func (m *signingKeyManager) sign(claims jwt.MapClaims, tokenType string) (string, error) {
+	key, err := m.activeKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.kid
+	token.Header["typ"] = tokenType
+	return token.SignedString(key.key)
+}
+
+func generateSigningKey() (signingKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return signingKey{}, err
+	}
+	return signingKey{kid: jwkThumbprint(&key.PublicKey), key: key, createdAt: time.Now()}, nil
+}
+
+func readSigningKeys(directory string) ([]signingKey, error) {
+	files, err := filepath.Glob(filepath.Join(directory, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []signingKey
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		pemBytes, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid signing key %s: %v", filepath.Base(file), err)
+		}
+		keys = append(keys, signingKey{kid: jwkThumbprint(&key.PublicKey), key: key, createdAt: info.ModTime()})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No signing keys found in %s", directory)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].createdAt.After(keys[j].createdAt)
+	})
+	return keys, nil
+}
+
+func publicJWK(key *rsa.PublicKey) map[string]interface{} {
+	return map[string]interface{}{
+		"kty": "RSA",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// jwkThumbprint is the RFC 7638 thumbprint of the public key, used as key id
+func jwkThumbprint(key *rsa.PublicKey) string {
+	jwk := publicJWK(key)
+	canonical := `{"e":"` + jwk["e"].(string) + `","kty":"RSA","n":"` + jwk["n"].(string) + `"}`
+	hash := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// startMappingSweeper periodically archives mappings whose validity window has ended
+func startMappingSweeper(config config) {
+	if config.mappingSweepInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(config.mappingSweepInterval)
+	for {
+		archived, err := dbArchiveExpiredMappings(context.Background(), config, time.Now())
+		if err != nil {
+			Logger.Error(err)
+		} else if archived > 0 {
+			Logger.Infof("Archived %d expired mappings", archived)
+		}
+
+		<-ticker.C
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Traces are exported over OTLP only if an OTLP endpoint is configured or OTEL_TRACES_EXPORTER is
+// "otlp", otherwise spans are not recorded. Endpoint, headers, protocol, sampler and resource are
+// read by the SDK from the standard OTEL_* variables. W3C trace context is always propagated, so
+// policy requests continue the trace of the incoming request even without an exporter.
+const tracingServiceName = "claim-mapping-service"
+
+var tracer = otel.Tracer("github.com/eclipse-xfsc/portal-claim-mapping-service")
+
+// initTracing installs the tracer provider and returns the function flushing it on shutdown
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	noShutdown := func(context.Context) error { return nil }
+	if !tracingEnabled() {
+		return noShutdown, nil
+	}
+
+	var exporter *otlptrace.Exporter
+	var err error
+	if tracingProtocol() == "grpc" {
+		exporter, err = otlptracegrpc.New(ctx)
+	} else {
+		exporter, err = otlptracehttp.New(ctx)
+	}
+	if err != nil {
+		return noShutdown, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default service name
+	traceResource, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", tracingServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return noShutdown, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(traceResource))
+	otel.SetTracerProvider(provider)
+	Logger.Info("Exporting traces over OTLP")
+	return provider.Shutdown, nil
+}
+
+func tracingEnabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	exporter, found := os.LookupEnv("OTEL_TRACES_EXPORTER")
+	if found {
+		return exporter == "otlp"
+	}
+	return len(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")) > 0 || len(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")) > 0
+}
+
+func tracingProtocol() string {
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if len(protocol) == 0 {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	return protocol
+}
+
+// tracedHandler starts a server span for every request except probes and metrics scrapes. The span is
+// renamed to the route template once the request was routed.
+func tracedHandler(handler http.Handler) http.Handler {
+	return otelhttp.NewHandler(handler, "http.server", otelhttp.WithFilter(func(r *http.Request) bool {
+		return !isProbe(r.RequestURI)
+	}))
+}
+
+// endSpan records the error, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
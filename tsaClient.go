@@ -1,52 +1,294 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
-	"strings"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func tsaGetContextClaimsRequest(contextPolicyURL string, context string, claims []string, token string) (map[string]interface{}, error) {
-	var resp *http.Response
-	var responseBody []byte
-	method := "POST"
-	emptyResponseBody := make(map[string]interface{})
-
-	requestBody := make(map[string]interface{})
-
-	requestBody["context"] = context
-	requestBody["claims"] = claims
-	requestBody["requestor"] = token
-	jsonBody, _ := json.Marshal(requestBody)
-
-	request, err := http.NewRequest(method, contextPolicyURL, strings.NewReader(string(jsonBody)))
-	request.Header.Set("Content-type", "application/json")	
-
-	resp, err = http.DefaultClient.Do(request)
-	if err == nil {
-		responseBody, err = ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
-		defer resp.Body.Close()
-		if resp.StatusCode >= 200 && resp.StatusCode <= 300 {
-			var f interface{}
-			json.Unmarshal(responseBody, &f)
-			switch f.(type) {
-			case []interface{}:
-				arrayResponseBody := make(map[string]interface{})
-				arrayResponseBody["claims"] = f
-				return arrayResponseBody, nil
-			}
+// tsaClient calls the policy services with its own timeouts instead of http.DefaultClient.
+// Transient failures are retried with jittered exponential backoff, and every policy service host
+// has a circuit breaker so that an unavailable service fails fast. The client is replaced when its
+// settings change on a configuration reload.
+var tsaClients atomic.Pointer[policyClient]
+
+func init() {
+	client, _ := newTSAClient(config{})
+	tsaClients.Store(client)
+}
+
+func tsaClient() *policyClient {
+	return tsaClients.Load()
+}
 
-			m := f.(map[string]interface{})
+type policyClient struct {
+	httpClient   *http.Client
+	credentials  *clientCredentials
+	maxRetries   int
+	retryBackoff time.Duration
+
+	circuitFailures int
+	circuitCooldown time.Duration
+	breakers        sync.Map
+}
+
+// policyStatusError is a non-2xx response of a policy service
+type policyStatusError struct {
+	StatusCode int
+}
+
+func (e *policyStatusError) Error() string {
+	return fmt.Sprintf("invalid Status code (%v)", e.StatusCode)
+}
+
+func newTSAClient(config config) (*policyClient, error) {
+	tlsConfig, err := policyTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   config.tsaConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   config.tsaConnectTimeout,
+		ResponseHeaderTimeout: config.tsaReadTimeout,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+	}
 
-			return m, nil
+	return &policyClient{
+		// The transport records a client span per attempt and propagates the trace context
+		httpClient:      &http.Client{Transport: otelhttp.NewTransport(transport)},
+		credentials:     newClientCredentials(config),
+		maxRetries:      config.tsaMaxRetries,
+		retryBackoff:    config.tsaRetryBackoff,
+		circuitFailures: config.tsaCircuitFailures,
+		circuitCooldown: config.tsaCircuitCooldown,
+	}, nil
+}
+
+func initTSAClient(config config) error {
+	client, err := newTSAClient(config)
+	if err != nil {
+		return err
+	}
+	previousClient := tsaClients.Swap(client)
+	previousClient.close()
+	return nil
+}
+
+// circuitStates returns the circuit breaker state of every policy service host called so far
+func (c *policyClient) circuitStates() map[string]string {
+	states := make(map[string]string)
+	c.breakers.Range(func(host, breaker interface{}) bool {
+		states[host.(string)] = breaker.(*circuitBreaker).currentState()
+		return true
+	})
+	return states
+}
+
+// close drops the idle connections, requests still running finish normally
+func (c *policyClient) close() {
+	c.httpClient.CloseIdleConnections()
+}
+
+func (c *policyClient) breaker(url string) *circuitBreaker {
+	host := policyHost(url)
+	breaker, _ := c.breakers.LoadOrStore(host, newCircuitBreaker(host, c.circuitFailures, c.circuitCooldown))
+	return breaker.(*circuitBreaker)
+}
+
+// policyHost identifies a policy service in metrics, traces, logs and health reports. Policy URLs
+// are set per context through the API, so only the scheme and host are used: the number of label
+// values stays bounded and credentials, paths and query strings are never exposed.
+func policyHost(rawURL string) string {
+	parsedURL, err := neturl.Parse(rawURL)
+	if err != nil || len(parsedURL.Host) == 0 {
+		return "invalid"
+	}
+	return parsedURL.Scheme + "://" + parsedURL.Host
+}
+
+// post sends the JSON body to the policy URL and returns the response body of a 2xx response
+func (c *policyClient) post(ctx context.Context, url string, body []byte) (responseBody []byte, err error) {
+	host := policyHost(url)
+	ctx, span := tracer.Start(ctx, "policy.request", trace.WithAttributes(attribute.String("policy.host", host)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	breaker := c.breaker(url)
+	backoff := c.retryBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := breaker.allow()
+		if err != nil {
+			policyRequestErrors.WithLabelValues(host, policyErrorReason(ctx, err)).Inc()
+			return nil, err
+		}
+		start := time.Now()
+		responseBody, err := c.postOnce(ctx, url, body)
+		if err != nil && ctx.Err() != nil {
+			// The caller canceled or ran out of time, which tells nothing about the policy service
+			breaker.release()
 		} else {
-			err = fmt.Errorf("invalid Status code (%v)", resp.StatusCode)
-			return emptyResponseBody, err
+			breaker.done(err == nil || !isPolicyServiceFailure(err))
+		}
+		if err == nil {
+			policyRequestDuration.WithLabelValues(host, "ok").Observe(time.Since(start).Seconds())
+			return responseBody, nil
+		}
+		policyRequestDuration.WithLabelValues(host, "error").Observe(time.Since(start).Seconds())
+		policyRequestErrors.WithLabelValues(host, policyErrorReason(ctx, err)).Inc()
+
+		// A rejected access token was dropped, the next attempt fetches a new one
+		retryable := isRetryablePolicyError(err) || (c.credentials != nil && isPolicyStatus(err, http.StatusUnauthorized))
+		if attempt >= c.maxRetries || !retryable || ctx.Err() != nil {
+			return nil, err
+		}
+
+		// Jittered exponential backoff, between half and one and a half times the current backoff
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff)+1))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+func (c *policyClient) postOnce(ctx context.Context, url string, body []byte) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-type", "application/json")
+	if c.credentials != nil {
+		accessToken, err := c.credentials.token(ctx, c.httpClient)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		return emptyResponseBody, err
+		request.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	resp, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized && c.credentials != nil {
+		c.credentials.invalidate()
+	}
+
+	responseBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &policyStatusError{StatusCode: resp.StatusCode}
+	}
+	return responseBody, nil
+}
+
+// isRetryablePolicyError reports whether the evaluation may succeed when repeated. Evaluations do not
+// change state, so connection failures, timeouts of a single attempt and overloaded services are retried.
+func isRetryablePolicyError(err error) bool {
+	var statusError *policyStatusError
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode == http.StatusTooManyRequests || statusError.StatusCode == http.StatusBadGateway ||
+			statusError.StatusCode == http.StatusServiceUnavailable || statusError.StatusCode == http.StatusGatewayTimeout
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+func isPolicyStatus(err error, statusCode int) bool {
+	var statusError *policyStatusError
+	return errors.As(err, &statusError) && statusError.StatusCode == statusCode
+}
+
+// isPolicyServiceFailure reports whether the error counts against the circuit breaker, client errors do not
+func isPolicyServiceFailure(err error) bool {
+	var statusError *policyStatusError
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode >= 500 || statusError.StatusCode == http.StatusTooManyRequests
 	}
-}
\ No newline at end of file
+	return true
+}
+
+// parsePolicyResult reads the decision of a policy, either the array of allowed claims or an
+// object with the allowed claims, optional reasons per claim and the version of the evaluated policy.
+func parsePolicyResult(responseBody []byte) (policyResult, error) {
+	trimmedBody := bytes.TrimSpace(responseBody)
+	if len(trimmedBody) == 0 {
+		return policyResult{}, fmt.Errorf("invalid policy response: empty body")
+	}
+	if !json.Valid(trimmedBody) {
+		return policyResult{}, fmt.Errorf("invalid policy response: body is not valid JSON")
+	}
+
+	switch trimmedBody[0] {
+	case '[':
+		var claims []interface{}
+		json.Unmarshal(trimmedBody, &claims)
+		response := policyResult{Claims: []string{}}
+		for index, claim := range claims {
+			claimString, ok := claim.(string)
+			if !ok {
+				return policyResult{}, fmt.Errorf("invalid policy response: claims[%d] is not a string", index)
+			}
+			response.Claims = append(response.Claims, claimString)
+		}
+		return response, nil
+	case '{':
+		var fields map[string]json.RawMessage
+		json.Unmarshal(trimmedBody, &fields)
+		claims, found := fields["claims"]
+		if !found || string(claims) == "null" {
+			return policyResult{}, fmt.Errorf("invalid policy response: \"claims\" is missing")
+		}
+
+		var response policyResult
+		decoder := json.NewDecoder(bytes.NewReader(trimmedBody))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&response)
+		if err != nil {
+			return policyResult{}, fmt.Errorf("invalid policy response: %v", err)
+		}
+		return response, nil
+	}
+
+	return policyResult{}, fmt.Errorf("invalid policy response: expected an array or an object")
+}
+
+func tsaGetContextClaimsRequest(ctx context.Context, contextPolicyURL string, request policyRequest) (policyResult, error) {
+	jsonBody, _ := json.Marshal(request)
+
+	responseBody, err := tsaClient().post(ctx, contextPolicyURL, jsonBody)
+	if err != nil {
+		return policyResult{}, err
+	}
+
+	return parsePolicyResult(responseBody)
+}